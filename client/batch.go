@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Batch is a group of puts and deletes sent to the server in one round trip.
+// Unlike a storage.Batch it isn't atomic, each write is applied on its own.
+type Batch struct {
+	cmds [][]interface{}
+}
+
+// NewBatch returns an empty Batch.
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds a put of key with the default expiry of the server.
+func (b *Batch) Put(key, value []byte) {
+	b.cmds = append(b.cmds, []interface{}{"SET", key, value})
+}
+
+// PutWithTTL adds a put of key expiring after ttl, a ttl <= 0 is the same as Put.
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	b.cmds = append(b.cmds, setArgs(key, value, ttl))
+}
+
+// Del adds a delete of key, deleting a missing key isn't an error.
+func (b *Batch) Del(key []byte) {
+	b.cmds = append(b.cmds, []interface{}{"DEL", key})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.cmds)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.cmds = b.cmds[:0]
+}
+
+// Write sends the writes of b in one round trip, and returns the first error
+// replied by the server. The writes before and after the failed one are
+// applied.
+func (c *Client) Write(ctx context.Context, b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	replies, err := c.pipeline(ctx, b.cmds)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(Error); ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+// Package client is a client of the moused server. It speaks RESP, the
+// protocol of the server listener, over a pool of connections.
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a key doesn't exist.
+	ErrNotFound = errors.New("mousedb: not found")
+	// ErrClosed is returned when the client is closed.
+	ErrClosed = errors.New("mousedb: client is closed")
+)
+
+const (
+	defaultPoolSize        = 10
+	defaultDialTimeout     = 5 * time.Second
+	defaultMaxRetries      = 3
+	defaultMinRetryBackoff = 8 * time.Millisecond
+	defaultMaxRetryBackoff = 512 * time.Millisecond
+)
+
+// Options tunes a Client.
+type Options struct {
+	PoolSize    int           // the most open connections, 10 if 0
+	DialTimeout time.Duration // 5s if 0
+	// MaxRetries is how many times a command failing on its connection is
+	// sent again on another one, 3 if 0, never if < 0, see Client.Do for
+	// the commands retried. The retries wait from MinRetryBackoff, 8ms if
+	// 0, doubling up to MaxRetryBackoff, 512ms if 0.
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+// Client is a client of a moused server, safe for concurrent use. The
+// deadline and cancellation of the context of a call apply to waiting for a
+// connection, the retries and the round trip to the server.
+type Client struct {
+	addr string
+	opts Options
+
+	tokens chan struct{} // a token per open connection
+	idle   chan *conn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New returns a new Client of the server at addr, the connections are
+// opened when needed.
+func New(addr string, opts *Options) *Client {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.PoolSize <= 0 {
+		o.PoolSize = defaultPoolSize
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = defaultDialTimeout
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = defaultMaxRetries
+	}
+	if o.MinRetryBackoff <= 0 {
+		o.MinRetryBackoff = defaultMinRetryBackoff
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	return &Client{
+		addr:   addr,
+		opts:   o,
+		tokens: make(chan struct{}, o.PoolSize),
+		idle:   make(chan *conn, o.PoolSize),
+	}
+}
+
+// Close closes the idle connections, and the busy ones once they are done.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.close()
+			<-c.tokens
+		default:
+			return nil
+		}
+	}
+}
+
+// Ping checks the server answers.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key []byte) ([]byte, error) {
+	reply, err := c.Do(ctx, "GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, errProtocol
+	}
+	return value, nil
+}
+
+// Put sets the value of key, the key expires after the default expiry of the
+// server.
+func (c *Client) Put(ctx context.Context, key, value []byte) error {
+	_, err := c.Do(ctx, "SET", key, value)
+	return err
+}
+
+// PutWithTTL sets the value of key, the key expires after ttl, rounded up to
+// a second. A ttl <= 0 is the same as Put.
+func (c *Client) PutWithTTL(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	_, err := c.Do(ctx, setArgs(key, value, ttl)...)
+	return err
+}
+
+// Del deletes key, or returns ErrNotFound.
+func (c *Client) Del(ctx context.Context, key []byte) error {
+	reply, err := c.Do(ctx, "DEL", key)
+	if err != nil {
+		return err
+	}
+	if reply == int64(0) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Do sends a command and returns its reply: a string for a status, []byte
+// for a bulk string, int64 for an integer, []interface{} for an array and nil
+// for a null. An error replied by the server is returned as an Error.
+//
+// A command whose connection fails is sent again on another connection when
+// none of it was sent yet, or when it only reads, such as GET or SCAN. Other
+// commands, such as INCR or APPEND, are never sent twice: the error of the
+// connection is returned, and the command may or may not have been run.
+func (c *Client) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	replies, err := c.pipeline(ctx, [][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// pipeline sends the commands in one round trip and returns their replies,
+// retrying on another connection with backoff if dialing fails, or if the
+// connection fails before the commands are sent or they only read.
+func (c *Client) pipeline(ctx context.Context, cmds [][]interface{}) ([]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		cn, err := c.get(ctx)
+		if err == nil {
+			var replies []interface{}
+			replies, err = cn.roundTrip(ctx, cmds)
+			sent := cn.sent
+			c.put(cn)
+			if err == nil {
+				return replies, nil
+			}
+			if sent && !readOnly(cmds) {
+				return nil, err
+			}
+		}
+		if attempt >= c.opts.MaxRetries || !retryable(ctx, err) {
+			return nil, err
+		}
+		if err := c.backoff(ctx, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryable reports whether the command may succeed on another connection.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// readOnlyCommands are the commands which can be sent again when it is
+// unknown whether the server ran them.
+var readOnlyCommands = map[string]bool{
+	"GET": true, "MGET": true, "EXISTS": true, "TTL": true, "PTTL": true, "TYPE": true,
+	"STRLEN": true, "SCAN": true, "KEYS": true, "DBSIZE": true, "PING": true, "ECHO": true,
+	"INFO": true,
+}
+
+// readOnly reports whether all the commands only read.
+func readOnly(cmds [][]interface{}) bool {
+	for _, args := range cmds {
+		if len(args) == 0 {
+			return false
+		}
+		var name string
+		switch arg := args[0].(type) {
+		case string:
+			name = arg
+		case []byte:
+			name = string(arg)
+		}
+		if !readOnlyCommands[strings.ToUpper(name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// backoff waits before the retry after attempt, the wait doubles every
+// attempt and is randomized so the clients don't retry all at once.
+func (c *Client) backoff(ctx context.Context, attempt int) error {
+	d := c.opts.MinRetryBackoff << uint(attempt)
+	if d <= 0 || d > c.opts.MaxRetryBackoff {
+		d = c.opts.MaxRetryBackoff
+	}
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// get returns an idle connection, or dials a new one when the pool isn't
+// full. It waits for a connection otherwise.
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case c.tokens <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		<-c.tokens
+		return nil, err
+	}
+	return newConn(nc), nil
+}
+
+// put returns a connection to the pool, it is closed if it is broken or the
+// client is closed.
+func (c *Client) put(cn *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !cn.broken && !c.closed {
+		select {
+		case c.idle <- cn:
+			return
+		default:
+		}
+	}
+	cn.close()
+	<-c.tokens
+}
+
+// setArgs returns the arguments of a SET of key with a ttl in milliseconds.
+func setArgs(key, value []byte, ttl time.Duration) []interface{} {
+	if ttl <= 0 {
+		return []interface{}{"SET", key, value}
+	}
+	ms := (ttl + time.Millisecond - 1) / time.Millisecond
+	return []interface{}{"SET", key, value, "PX", strconv.FormatInt(int64(ms), 10)}
+}
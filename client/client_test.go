@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/pkg/assert"
+)
+
+// startServer starts a server on a random local port and returns its address.
+func startServer(t *testing.T) string {
+	c := run.NewConfig()
+	c.BindAddress = "127.0.0.1:0"
+	c.HTTPD.Enabled = false
+	c.Storage.Dir = t.TempDir()
+	c.Storage.MergeSecs = 0
+	s, err := run.NewServer(c, &run.BuildInfo{Version: "test"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	t.Cleanup(func() { assert.Nil(t, s.Close()) })
+	return s.Listener.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	c := New(startServer(t), nil)
+	defer c.Close()
+	ctx := context.Background()
+
+	assert.Nil(t, c.Ping(ctx))
+	_, err := c.Get(ctx, []byte("foo"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, c.Put(ctx, []byte("foo"), []byte("bar")))
+	value, err := c.Get(ctx, []byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(value))
+
+	assert.Nil(t, c.PutWithTTL(ctx, []byte("ttl"), []byte("v"), 1500*time.Millisecond))
+	reply, err := c.Do(ctx, "TTL", "ttl")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), reply)
+
+	assert.Nil(t, c.Del(ctx, []byte("foo")))
+	assert.Equal(t, ErrNotFound, c.Del(ctx, []byte("foo")))
+
+	_, err = c.Do(ctx, "NOPE")
+	var serverErr Error
+	assert.T(t, errors.As(err, &serverErr))
+	assert.Equal(t, "ERR unknown command 'NOPE', with args beginning with: ", err.Error())
+}
+
+func TestBatchAndScan(t *testing.T) {
+	c := New(startServer(t), &Options{PoolSize: 2})
+	defer c.Close()
+	ctx := context.Background()
+
+	b := NewBatch()
+	for i := 0; i < 250; i++ {
+		b.Put([]byte(fmt.Sprintf("key:%03d", i)), []byte(fmt.Sprint(i)))
+	}
+	b.Put([]byte("other"), []byte("x"))
+	b.Del([]byte("key:000"))
+	b.Del([]byte("missing"))
+	assert.Nil(t, c.Write(ctx, b))
+	_, err := c.Get(ctx, []byte("key:000"))
+	assert.Equal(t, ErrNotFound, err)
+
+	s := c.Scan(ctx, &ScanOptions{Prefix: []byte("key:"), Count: 30})
+	var keys []string
+	for s.Next() {
+		keys = append(keys, string(s.Key()))
+	}
+	assert.Nil(t, s.Err())
+	assert.Equal(t, 249, len(keys))
+	assert.Equal(t, "key:001", keys[0])
+	assert.Equal(t, "key:249", keys[248])
+
+	// a failed write doesn't stop the others
+	b.Reset()
+	b.Put([]byte("a"), []byte("1"))
+	b.cmds = append(b.cmds, []interface{}{"INCRBY", "a", "x"})
+	b.Put([]byte("b"), []byte("2"))
+	assert.Equal(t, Error("ERR value is not an integer or out of range"), c.Write(ctx, b))
+	value, err := c.Get(ctx, []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(value))
+}
+
+func TestConcurrentCalls(t *testing.T) {
+	c := New(startServer(t), &Options{PoolSize: 4})
+	defer c.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("%d:%d", g, i))
+				assert.Nil(t, c.Put(ctx, key, key))
+				value, err := c.Get(ctx, key)
+				assert.Nil(t, err)
+				assert.Equal(t, string(key), string(value))
+			}
+		}(g)
+	}
+	wg.Wait()
+	reply, err := c.Do(ctx, "DBSIZE")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(16*50), reply)
+}
+
+func TestContextDeadline(t *testing.T) {
+	c := New(startServer(t), &Options{PoolSize: 1})
+	defer c.Close()
+
+	// a scan leaves the only connection to the other commands between its pages
+	assert.Nil(t, c.Put(context.Background(), []byte("a"), []byte("1")))
+	assert.Nil(t, c.Put(context.Background(), []byte("b"), []byte("2")))
+	s := c.Scan(context.Background(), &ScanOptions{Count: 1})
+	assert.T(t, s.Next())
+	_, err := c.Get(context.Background(), []byte("a"))
+	assert.Nil(t, err)
+	assert.T(t, s.Next())
+	assert.Equal(t, "b", string(s.Key()))
+	assert.T(t, !s.Next())
+	assert.Nil(t, s.Err())
+
+	// a command waits for the connection held by another one
+	cn, err := c.get(context.Background())
+	assert.Nil(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = c.Get(ctx, []byte("a"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	c.put(cn)
+	_, err = c.Get(context.Background(), []byte("a"))
+	assert.Nil(t, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Get(ctx, []byte("a"))
+	assert.Equal(t, context.Canceled, err)
+
+	assert.Nil(t, c.Close())
+	assert.Equal(t, ErrClosed, c.Ping(context.Background()))
+}
+
+func TestRetry(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	// the first connections are dropped once a command is read, before
+	// replying
+	var mu sync.Mutex
+	drops, received := 0, 0
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					// $len and the argument
+					for i := 0; i < 2*n; i++ {
+						if _, err := r.ReadString('\n'); err != nil {
+							return
+						}
+					}
+					mu.Lock()
+					received++
+					drop := drops > 0
+					drops--
+					mu.Unlock()
+					if drop {
+						return
+					}
+					nc.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+	setDrops := func(n int) {
+		mu.Lock()
+		drops, received = n, 0
+		mu.Unlock()
+	}
+
+	setDrops(2)
+	c := New(ln.Addr().String(), &Options{MaxRetries: -1})
+	assert.T(t, c.Ping(context.Background()) != nil)
+	c.Close()
+
+	c = New(ln.Addr().String(), &Options{MaxRetries: 3, MinRetryBackoff: time.Millisecond})
+	defer c.Close()
+	assert.Nil(t, c.Ping(context.Background()))
+
+	// a command which writes isn't sent again once it reached the server
+	setDrops(1)
+	_, err = c.Do(context.Background(), "INCR", "counter")
+	assert.T(t, err != nil)
+	mu.Lock()
+	assert.Equal(t, 1, received)
+	mu.Unlock()
+	b := NewBatch()
+	b.Put([]byte("a"), []byte("1"))
+	setDrops(1)
+	assert.T(t, c.Write(context.Background(), b) != nil)
+	mu.Lock()
+	assert.Equal(t, 1, received)
+	mu.Unlock()
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is an error replied by the server, such as "ERR syntax error".
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// errProtocol is returned when a reply can't be parsed, the connection is
+// closed.
+var errProtocol = errors.New("mousedb: protocol error")
+
+// conn is a connection to the server, used by one caller at a time.
+type conn struct {
+	nc  net.Conn
+	r   *bufio.Reader
+	w   *bufio.Writer
+	num []byte
+
+	broken bool // the connection is out of sync and can't be reused
+	sent   bool // bytes of the last round trip reached the connection
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{
+		nc: nc,
+		r:  bufio.NewReaderSize(nc, 16<<10),
+	}
+	cn.w = bufio.NewWriterSize(sendWriter{cn}, 16<<10)
+	return cn
+}
+
+// sendWriter writes to the connection and records that bytes were sent.
+type sendWriter struct {
+	cn *conn
+}
+
+func (w sendWriter) Write(p []byte) (int, error) {
+	n, err := w.cn.nc.Write(p)
+	if n > 0 {
+		w.cn.sent = true
+	}
+	return n, err
+}
+
+// watch sets the deadline of the connection to the deadline of ctx, and
+// interrupts the connection if ctx is done first. The returned function
+// stops watching, it must be called before the connection is reused.
+func (cn *conn) watch(ctx context.Context) func() {
+	deadline, _ := ctx.Deadline()
+	cn.nc.SetDeadline(deadline)
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			cn.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// writeCommand buffers a command as an array of bulk strings.
+func (cn *conn) writeCommand(args ...interface{}) error {
+	cn.w.WriteByte('*')
+	cn.writeNum(int64(len(args)))
+	for _, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			cn.writeBulk(arg)
+		case string:
+			cn.writeBulk([]byte(arg))
+		case int:
+			cn.writeBulk([]byte(strconv.Itoa(arg)))
+		case int64:
+			cn.writeBulk([]byte(strconv.FormatInt(arg, 10)))
+		case uint64:
+			cn.writeBulk([]byte(strconv.FormatUint(arg, 10)))
+		default:
+			return fmt.Errorf("mousedb: can't send an argument of type %T", arg)
+		}
+	}
+	return nil
+}
+
+func (cn *conn) writeNum(n int64) {
+	cn.num = strconv.AppendInt(cn.num[:0], n, 10)
+	cn.w.Write(cn.num)
+	cn.w.WriteString("\r\n")
+}
+
+func (cn *conn) writeBulk(b []byte) {
+	cn.w.WriteByte('$')
+	cn.writeNum(int64(len(b)))
+	cn.w.Write(b)
+	cn.w.WriteString("\r\n")
+}
+
+// readReply reads a reply: a string for a simple string, []byte for a bulk
+// string, int64 for an integer, []interface{} for an array, nil for a null
+// and Error for an error.
+func (cn *conn) readReply() (interface{}, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			if elems[i], err = cn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, errProtocol
+}
+
+func (cn *conn) readLine() ([]byte, error) {
+	line, err := cn.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// roundTrip sends the commands at once and reads their replies. The replies
+// which are server errors are returned as Error values, the error is only for
+// the connection, after which it is broken. cn.sent tells whether the
+// commands may have reached the server when it fails.
+func (cn *conn) roundTrip(ctx context.Context, cmds [][]interface{}) ([]interface{}, error) {
+	stop := cn.watch(ctx)
+	defer stop()
+	cn.sent = false
+	for _, args := range cmds {
+		if err := cn.writeCommand(args...); err != nil {
+			// a part of the commands may be sent already
+			cn.broken = true
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		cn.broken = true
+		return nil, ctxErr(ctx, err)
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		reply, err := cn.readReply()
+		if err != nil {
+			cn.broken = true
+			return nil, ctxErr(ctx, err)
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (cn *conn) close() error {
+	return cn.nc.Close()
+}
+
+// ctxErr returns the error of ctx if the connection failed because ctx is
+// done.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
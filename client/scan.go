@@ -0,0 +1,120 @@
+package client
+
+import "context"
+
+// the keys asked for a page of a scan by default
+const defaultScanCount = 100
+
+// ScanOptions tunes a Scan.
+type ScanOptions struct {
+	Prefix []byte // only scan the keys starting with Prefix
+	Count  int    // the keys asked for in a round trip, 100 if <= 0
+}
+
+// Scanner walks the keys in key order, a page at a time. Every page is a
+// command of its own on any connection of the pool, the server keeps the
+// position of a scan behind its cursor for all the connections.
+type Scanner struct {
+	c       *Client
+	ctx     context.Context
+	pattern string
+	count   int
+
+	cursor string
+	keys   [][]byte
+	key    []byte
+	done   bool
+	err    error
+}
+
+// Scan returns a Scanner of the keys, the context applies to all the round
+// trips of the scan.
+func (c *Client) Scan(ctx context.Context, opts *ScanOptions) *Scanner {
+	if opts == nil {
+		opts = &ScanOptions{}
+	}
+	s := &Scanner{
+		c:       c,
+		ctx:     ctx,
+		pattern: escapeGlob(opts.Prefix) + "*",
+		count:   opts.Count,
+		cursor:  "0",
+	}
+	if s.count <= 0 {
+		s.count = defaultScanCount
+	}
+	return s
+}
+
+// Next moves to the next key, it returns false when there is none left or
+// the scan failed.
+func (s *Scanner) Next() bool {
+	for len(s.keys) == 0 {
+		if s.done || s.err != nil {
+			s.Close()
+			return false
+		}
+		s.err = s.fetch()
+	}
+	s.key, s.keys = s.keys[0], s.keys[1:]
+	return true
+}
+
+// fetch asks the server for the next page.
+func (s *Scanner) fetch() error {
+	reply, err := s.c.Do(s.ctx, "SCAN", s.cursor, "MATCH", s.pattern, "COUNT", s.count)
+	if err != nil {
+		return err
+	}
+	page, ok := reply.([]interface{})
+	if !ok || len(page) != 2 {
+		return errProtocol
+	}
+	cursor, ok := page[0].([]byte)
+	if !ok {
+		return errProtocol
+	}
+	keys, ok := page[1].([]interface{})
+	if !ok {
+		return errProtocol
+	}
+	for _, key := range keys {
+		key, ok := key.([]byte)
+		if !ok {
+			return errProtocol
+		}
+		s.keys = append(s.keys, key)
+	}
+	s.cursor = string(cursor)
+	s.done = s.cursor == "0"
+	return nil
+}
+
+// Key returns the current key.
+func (s *Scanner) Key() []byte {
+	return s.key
+}
+
+// Err returns the error which ended the scan, if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Close ends the scan, it is called by Next once the scan ends.
+func (s *Scanner) Close() error {
+	s.done = true
+	return nil
+}
+
+// escapeGlob escapes the special characters of a glob pattern in prefix.
+func escapeGlob(prefix []byte) string {
+	b := make([]byte, 0, len(prefix))
+	for _, c := range prefix {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
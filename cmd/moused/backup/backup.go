@@ -0,0 +1,122 @@
+// Package backup is the backup subcommand of the moused command.
+package backup
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/pkg/logger"
+	"mousedb/service/storage"
+)
+
+// Command writes a backup of the storage of a node.
+type Command struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewCommand returns a new instance of Command.
+func NewCommand() *Command {
+	return &Command{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *Command) Run(args ...string) error {
+	var configPath, dataDir, dir, out string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "")
+	fs.StringVar(&dataDir, "datadir", "", "")
+	fs.StringVar(&dir, "dir", "", "")
+	fs.StringVar(&out, "out", "", "")
+	fs.Usage = func() { fmt.Fprintln(cmd.Stderr, usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (dir == "") == (out == "") {
+		fs.Usage()
+		return fmt.Errorf("one of -dir and -out is required")
+	}
+
+	config, err := run.NewCommand().ParseConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("parse config: %s", err)
+	}
+	if dataDir != "" {
+		config.Storage.Dir = dataDir
+	}
+
+	// the files of a running node can't be backed up from here, its merges
+	// would mix with the copy: the node backs itself up
+	config.Storage.OpenTimeoutSecs = 0
+	config.Storage.MergeSecs = 0
+	config.Storage.RefreshSecs = 0
+	s := storage.New(&config.Storage)
+	s.WithLogger(logger.New(cmd.Stderr))
+	var manifest *storage.BackupManifest
+	if err := s.Open(); errors.Is(err, storage.ErrLocked) {
+		manifest, err = cmd.backupNode(config, dir, out)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		defer s.Close()
+		if dir != "" {
+			manifest, err = s.BackupDir(dir)
+		} else if out == "-" {
+			manifest, err = s.Backup(cmd.Stdout)
+		} else {
+			manifest, err = backupFile(s, out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if out != "-" {
+		fmt.Fprintf(cmd.Stdout, "backed up %d files\n", len(manifest.Files))
+	}
+	return nil
+}
+
+// backupFile writes the backup of s as a tar file at path.
+func backupFile(s *storage.Storage, path string) (*storage.BackupManifest, error) {
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := s.Backup(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+const usage = `Writes a backup of the storage while the node keeps running.
+Usage: moused backup [flags]
+    -config <path>
+            Set the path to the configuration file.
+    -datadir <path>
+            Back up the storage in this directory instead of the configured one.
+    -dir <path>
+            Write the backup into this new or empty directory.
+    -out <path>
+            Write the backup as a tar file, or to stdout when path is -.
+
+A running node holds the lock of the storage, it is asked for the backup
+over its http service, which must be enabled in the configuration. A node
+which isn't running is backed up directly.`
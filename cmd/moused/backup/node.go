@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/service/storage"
+)
+
+// errNodeHTTPDisabled is returned when the node holding the storage can't be
+// asked for a backup.
+var errNodeHTTPDisabled = errors.New("the storage is used by a running node with its http service disabled, enable it or stop the node to back it up")
+
+// backupNode asks the running node for a backup over its HTTP service, so
+// the node rotates its writeable file and keeps its merges off the files
+// backed up. The backup is verified against its manifest as it is received.
+func (cmd *Command) backupNode(config *run.Config, dir, out string) (*storage.BackupManifest, error) {
+	if !config.HTTPD.Enabled {
+		return nil, errNodeHTTPDisabled
+	}
+	resp, err := http.Get("http://" + config.HTTPD.BindAddress + "/v1/backup")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return nil, fmt.Errorf("backup of the node failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	switch {
+	case dir != "":
+		return receiveDir(resp.Body, dir)
+	case out == "-":
+		return receiveStream(cmd.Stdout, resp.Body)
+	}
+	fp, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := receiveStream(fp, resp.Body)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(out)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// receiveStream copies the tar stream of a backup from r to w as is.
+func receiveStream(w io.Writer, r io.Reader) (*storage.BackupManifest, error) {
+	manifest, err := receive(io.TeeReader(r, w), func(string) (io.WriteCloser, error) {
+		return nopCloser{io.Discard}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the end of the archive
+	_, err = io.Copy(w, r)
+	return manifest, err
+}
+
+// receiveDir writes the files of the tar stream of a backup into dir, which
+// must not exist or be empty, as storage.BackupDir does.
+func receiveDir(r io.Reader, dir string) (*storage.BackupManifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		return nil, fmt.Errorf("%s is not empty", dir)
+	}
+	manifest, err := receive(r, func(name string) (io.WriteCloser, error) {
+		fp, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return syncCloser{fp}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return manifest, fp.Sync()
+}
+
+// receive reads the tar stream of a backup, and writes every file to the
+// writer create returns for its name. The manifest, the last file, is only
+// written once the files match it.
+func receive(r io.Reader, create func(name string) (io.WriteCloser, error)) (*storage.BackupManifest, error) {
+	files := make(map[string]storage.BackupFile)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: the manifest is missing", storage.ErrBadBackup)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name != filepath.Base(header.Name) || strings.HasPrefix(header.Name, ".") {
+			return nil, fmt.Errorf("%w: unexpected file %s", storage.ErrBadBackup, header.Name)
+		}
+		if header.Name == storage.BackupManifestName {
+			return receiveManifest(tr, files, create)
+		}
+		w, err := create(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, h), tr)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = storage.BackupFile{Name: header.Name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+}
+
+// receiveManifest checks the files received against the manifest read from
+// r, then writes it.
+func receiveManifest(r io.Reader, files map[string]storage.BackupFile, create func(name string) (io.WriteCloser, error)) (*storage.BackupManifest, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &storage.BackupManifest{}
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", storage.ErrBadBackup, err)
+	}
+	if len(manifest.Files) != len(files) {
+		return nil, fmt.Errorf("%w: %d files for %d in the manifest", storage.ErrBadBackup, len(files), len(manifest.Files))
+	}
+	for _, f := range manifest.Files {
+		got, ok := files[f.Name]
+		if !ok || got.Size != f.Size || got.SHA256 != f.SHA256 {
+			return nil, fmt.Errorf("%w: %s", storage.ErrBadBackup, f.Name)
+		}
+	}
+	w, err := create(storage.BackupManifestName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return manifest, err
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// syncCloser syncs the file before closing it.
+type syncCloser struct{ *os.File }
+
+func (fp syncCloser) Close() error {
+	err := fp.Sync()
+	if cerr := fp.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,467 @@
+// Package cli is the cli subcommand of the moused command, a shell of a
+// running server.
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mousedb/client"
+	"mousedb/cmd/moused/run"
+
+	"github.com/mattn/go-isatty"
+)
+
+// The output modes of the keys and values.
+const (
+	modeRaw    = "raw"
+	modeHex    = "hex"
+	modeBase64 = "base64"
+)
+
+// the keys a scan lists by default
+const defaultScanLimit = 100
+
+// errQuit is returned by the quit command.
+var errQuit = errors.New("quit")
+
+// Command is a shell of a running server, it reads the commands from the
+// terminal with line editing, or from a script on stdin.
+type Command struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	client  *client.Client
+	mode    string
+	timeout time.Duration
+}
+
+// NewCommand returns a new instance of Command.
+func NewCommand() *Command {
+	return &Command{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// command is a command of the shell.
+type command struct {
+	fn    func(cmd *Command, ctx context.Context, args []string) error
+	usage string
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"get":   {(*Command).get, "get <key>                  print the value of key"},
+		"put":   {(*Command).put, "put <key> <value> [ttl]    set the value of key, expiring after ttl (10s, 5m...)"},
+		"del":   {(*Command).del, "del <key>...               delete the keys"},
+		"scan":  {(*Command).scan, "scan [prefix] [limit]      list the keys starting with prefix, 100 by default, 0 for all"},
+		"stats": {(*Command).stats, "stats [section]            print the statistics of the server"},
+		"ping":  {(*Command).ping, "ping                       check the server answers"},
+		"mode":  {(*Command).setMode, "mode [raw|hex|base64]      print or set how the keys and values are printed"},
+		"help":  {(*Command).help, "help                       print this help"},
+		"quit":  {(*Command).quit, "quit                       leave the shell, as exit and ctrl-d"},
+		"exit":  {(*Command).quit, ""},
+	}
+}
+
+// Run executes the command.
+func (cmd *Command) Run(args ...string) error {
+	var host, historyPath string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&host, "host", run.DefaultBindAddress, "")
+	fs.StringVar(&cmd.mode, "mode", modeRaw, "")
+	fs.DurationVar(&cmd.timeout, "timeout", 10*time.Second, "")
+	fs.StringVar(&historyPath, "history", defaultHistoryPath(), "")
+	fs.Usage = func() { fmt.Fprintln(cmd.Stderr, usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkMode(cmd.mode); err != nil {
+		return err
+	}
+
+	cmd.client = client.New(host, &client.Options{PoolSize: 1})
+	defer cmd.client.Close()
+
+	if f, ok := cmd.Stdin.(*os.File); ok && isatty.IsTerminal(f.Fd()) {
+		return cmd.interactive(int(f.Fd()), host, historyPath)
+	}
+	return cmd.script()
+}
+
+// interactive runs the commands typed in the terminal until quit or ctrl-d.
+func (cmd *Command) interactive(fd int, host, historyPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.timeout)
+	err := cmd.client.Ping(ctx)
+	cancel()
+	if err != nil {
+		fmt.Fprintf(cmd.Stderr, "can't reach %s: %v\n", host, err)
+	}
+
+	e := newLineEditor(cmd.Stdin, fd, cmd.Stdout)
+	e.complete = completeCommand
+	e.history = readHistory(historyPath)
+	defer writeHistory(historyPath, e)
+	for {
+		line, err := e.readLine(host + "> ")
+		if err == errInterrupted {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e.addHistory(strings.TrimSpace(line))
+		if err := cmd.exec(line); err == errQuit {
+			return nil
+		} else if err != nil {
+			fmt.Fprintf(cmd.Stdout, "(error) %v\n", err)
+		}
+	}
+}
+
+// script runs the commands read from stdin, one per line. The failed commands
+// are reported and skipped, blank lines and lines starting with # are
+// ignored.
+func (cmd *Command) script() error {
+	s := bufio.NewScanner(cmd.Stdin)
+	s.Buffer(nil, 64<<20)
+	var n, failed int
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		n++
+		if err := cmd.exec(line); err == errQuit {
+			break
+		} else if err != nil {
+			fmt.Fprintf(cmd.Stderr, "line %d: %v\n", lineno, err)
+			failed++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, n)
+	}
+	return nil
+}
+
+// exec runs a line.
+func (cmd *Command) exec(line string) error {
+	args, err := splitArgs(line)
+	if err != nil || len(args) == 0 {
+		return err
+	}
+	c, ok := commands[strings.ToLower(args[0])]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type help for the commands", args[0])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.timeout)
+	defer cancel()
+	return c.fn(cmd, ctx, args[1:])
+}
+
+func (cmd *Command) get(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errUsage("get")
+	}
+	value, err := cmd.client.Get(ctx, []byte(args[0]))
+	if err == client.ErrNotFound {
+		fmt.Fprintln(cmd.Stdout, "(not found)")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, cmd.format(value))
+	return nil
+}
+
+func (cmd *Command) put(ctx context.Context, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		return errUsage("put")
+	}
+	var ttl time.Duration
+	if len(args) == 3 {
+		var err error
+		if ttl, err = parseTTL(args[2]); err != nil {
+			return err
+		}
+	}
+	if err := cmd.client.PutWithTTL(ctx, []byte(args[0]), []byte(args[1]), ttl); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "OK")
+	return nil
+}
+
+func (cmd *Command) del(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage("del")
+	}
+	cmdArgs := []interface{}{"DEL"}
+	for _, key := range args {
+		cmdArgs = append(cmdArgs, key)
+	}
+	reply, err := cmd.client.Do(ctx, cmdArgs...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "(deleted %d)\n", reply)
+	return nil
+}
+
+func (cmd *Command) scan(ctx context.Context, args []string) error {
+	if len(args) > 2 {
+		return errUsage("scan")
+	}
+	var prefix string
+	limit := defaultScanLimit
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return errUsage("scan")
+		}
+		limit = n
+	}
+	s := cmd.client.Scan(ctx, &client.ScanOptions{Prefix: []byte(prefix)})
+	defer s.Close()
+	n := 0
+	for s.Next() {
+		if limit > 0 && n == limit {
+			fmt.Fprintf(cmd.Stdout, "(%d keys, more left)\n", n)
+			return nil
+		}
+		fmt.Fprintln(cmd.Stdout, cmd.format(s.Key()))
+		n++
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "(%d keys)\n", n)
+	return nil
+}
+
+func (cmd *Command) stats(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errUsage("stats")
+	}
+	cmdArgs := []interface{}{"INFO"}
+	for _, section := range args {
+		cmdArgs = append(cmdArgs, section)
+	}
+	reply, err := cmd.client.Do(ctx, cmdArgs...)
+	if err != nil {
+		return err
+	}
+	info, _ := reply.([]byte)
+	fmt.Fprint(cmd.Stdout, strings.ReplaceAll(string(info), "\r\n", "\n"))
+	return nil
+}
+
+func (cmd *Command) ping(ctx context.Context, args []string) error {
+	if err := cmd.client.Ping(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintln(cmd.Stdout, "PONG")
+	return nil
+}
+
+func (cmd *Command) setMode(ctx context.Context, args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Fprintln(cmd.Stdout, cmd.mode)
+		return nil
+	case 1:
+		if err := checkMode(args[0]); err != nil {
+			return err
+		}
+		cmd.mode = args[0]
+		return nil
+	}
+	return errUsage("mode")
+}
+
+func (cmd *Command) help(ctx context.Context, args []string) error {
+	var lines []string
+	for _, c := range commands {
+		if c.usage != "" {
+			lines = append(lines, c.usage)
+		}
+	}
+	sort.Strings(lines)
+	fmt.Fprintln(cmd.Stdout, strings.Join(lines, "\n"))
+	fmt.Fprintln(cmd.Stdout, `
+The arguments are split on spaces, "double quoted" arguments take Go escapes
+such as \n and \x00, and 'single quoted' ones are taken as is.`)
+	return nil
+}
+
+func (cmd *Command) quit(ctx context.Context, args []string) error {
+	return errQuit
+}
+
+// format returns b in the output mode.
+func (cmd *Command) format(b []byte) string {
+	switch cmd.mode {
+	case modeHex:
+		return hex.EncodeToString(b)
+	case modeBase64:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func checkMode(mode string) error {
+	switch mode {
+	case modeRaw, modeHex, modeBase64:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, use raw, hex or base64", mode)
+}
+
+func errUsage(name string) error {
+	usage := commands[name].usage
+	if i := strings.Index(usage, "  "); i >= 0 {
+		usage = usage[:i]
+	}
+	return fmt.Errorf("usage: %s", usage)
+}
+
+// parseTTL parses a ttl as a duration, or as a number of seconds.
+func parseTTL(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return ttl, nil
+}
+
+// splitArgs splits a line on spaces. A "double quoted" argument is unquoted
+// as a Go string, a 'single quoted' one is taken as is.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		switch line[0] {
+		case '"':
+			end := 1
+			for ; end < len(line) && line[end] != '"'; end++ {
+				if line[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(line) {
+				return nil, errors.New("unterminated quote")
+			}
+			arg, err := strconv.Unquote(line[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", line[:end+1])
+			}
+			args, line = append(args, arg), line[end+1:]
+		case '\'':
+			end := strings.IndexByte(line[1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated quote")
+			}
+			args, line = append(args, line[1:end+1]), line[end+2:]
+		default:
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args, line = append(args, line[:end]), line[end:]
+		}
+	}
+}
+
+// completeCommand returns the commands starting with prefix.
+func completeCommand(prefix string) []string {
+	var names []string
+	for name := range commands {
+		if strings.HasPrefix(name, strings.ToLower(prefix)) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".moused_history")
+}
+
+// readHistory reads the history saved by writeHistory, none if path is empty.
+func readHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+	}
+	return lines
+}
+
+// writeHistory saves the history of e to path, nothing if path is empty.
+func writeHistory(path string, e *lineEditor) {
+	if path == "" || len(e.history) == 0 {
+		return
+	}
+	os.WriteFile(path, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+}
+
+const usage = `Opens a shell on a running MouseDB server.
+Usage: moused cli [flags]
+    -host <addr>
+            The address of the server, 127.0.0.1:8062 by default.
+    -mode <raw|hex|base64>
+            How the keys and values are printed, raw by default.
+    -timeout <duration>
+            The timeout of a command, 10s by default.
+    -history <path>
+            The file the history is saved to, ~/.moused_history by default,
+            none if empty.
+
+The commands are read from the terminal with line editing, history and tab
+completion, or one per line from stdin when it isn't a terminal. Type help
+in the shell for the commands.`
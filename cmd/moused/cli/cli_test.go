@@ -0,0 +1,156 @@
+package cli
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/pkg/assert"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		args []string
+		err  string
+	}{
+		{"get foo", []string{"get", "foo"}, ""},
+		{"  put \t k   v  ", []string{"put", "k", "v"}, ""},
+		{`put "a b" 'c d'`, []string{"put", "a b", "c d"}, ""},
+		{`put k "line\nnext\x00"`, []string{"put", "k", "line\nnext\x00"}, ""},
+		{`put k "say \"hi\""`, []string{"put", "k", `say "hi"`}, ""},
+		{`put k 'as\nis'`, []string{"put", "k", `as\nis`}, ""},
+		{`put k ""`, []string{"put", "k", ""}, ""},
+		{"", nil, ""},
+		{`put "k v`, nil, "unterminated quote"},
+		{`put "k\"`, nil, "unterminated quote"},
+		{`put 'k v`, nil, "unterminated quote"},
+		{`put "\q"`, nil, `invalid quoted argument "\q"`},
+	} {
+		args, err := splitArgs(tc.line)
+		if tc.err != "" {
+			assert.T(t, err != nil, tc.line)
+			assert.Equal(t, tc.err, err.Error())
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tc.args, args)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		ttl time.Duration
+		err string
+	}{
+		{"10", 10 * time.Second, ""},
+		{"0", 0, ""},
+		{"1m30s", 90 * time.Second, ""},
+		{"250ms", 250 * time.Millisecond, ""},
+		{"ten", 0, `invalid ttl "ten"`},
+		{"", 0, `invalid ttl ""`},
+	} {
+		ttl, err := parseTTL(tc.s)
+		if tc.err != "" {
+			assert.T(t, err != nil, tc.s)
+			assert.Equal(t, tc.err, err.Error())
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tc.ttl, ttl)
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	for _, tc := range []struct {
+		prefix string
+		names  []string
+	}{
+		{"", []string{"del", "exit", "get", "help", "mode", "ping", "put", "quit", "scan", "stats"}},
+		{"p", []string{"ping", "put"}},
+		{"S", []string{"scan", "stats"}},
+		{"get", []string{"get"}},
+		{"x", nil},
+	} {
+		assert.Equal(t, tc.names, completeCommand(tc.prefix))
+	}
+}
+
+func TestErrUsage(t *testing.T) {
+	for _, tc := range []struct {
+		name, usage string
+	}{
+		{"get", "usage: get <key>"},
+		{"put", "usage: put <key> <value> [ttl]"},
+		{"del", "usage: del <key>..."},
+		{"scan", "usage: scan [prefix] [limit]"},
+		{"mode", "usage: mode [raw|hex|base64]"},
+	} {
+		assert.Equal(t, tc.usage, errUsage(tc.name).Error())
+	}
+}
+
+func TestScript(t *testing.T) {
+	c := run.NewConfig()
+	c.BindAddress = "127.0.0.1:0"
+	c.HTTPD.Enabled = false
+	c.Storage.Dir = t.TempDir()
+	c.Storage.MergeSecs = 0
+	s, err := run.NewServer(c, &run.BuildInfo{Version: "test"})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+
+	script := `# a comment, then a blank line
+
+put foo bar
+put bin "\x00\xff"
+get foo
+get missing
+mode hex
+get foo
+get bin
+mode base64
+get bin
+mode raw
+scan
+bogus
+del foo nope
+get foo
+put onlykey
+quit
+bogus after quit
+`
+	var stdout, stderr bytes.Buffer
+	cmd := &Command{Stdin: strings.NewReader(script), Stdout: &stdout, Stderr: &stderr}
+	err = cmd.Run("-host", s.Listener.Addr().String(), "-history", "")
+	assert.T(t, err != nil)
+	assert.Equal(t, "2 of 16 commands failed", err.Error())
+	assert.Equal(t, `OK
+OK
+bar
+(not found)
+626172
+00ff
+AP8=
+bin
+foo
+(2 keys)
+(deleted 1)
+(not found)
+`, stdout.String())
+	assert.Equal(t, `line 14: unknown command "bogus", type help for the commands
+line 17: usage: put <key> <value> [ttl]
+`, stderr.String())
+
+	// the output mode of the flag
+	stdout.Reset()
+	cmd = &Command{Stdin: strings.NewReader("get bin\n"), Stdout: &stdout, Stderr: &stderr}
+	assert.Nil(t, cmd.Run("-host", s.Listener.Addr().String(), "-history", "", "-mode", "hex"))
+	assert.Equal(t, "00ff\n", stdout.String())
+	assert.Equal(t, `unknown mode "text", use raw, hex or base64`,
+		cmd.Run("-host", s.Listener.Addr().String(), "-mode", "text").Error())
+}
@@ -0,0 +1,239 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// the most lines kept in the history
+const maxHistory = 1000
+
+// errInterrupted is returned when the line is dropped with ctrl-c.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads lines from a terminal, with emacs style editing keys, the
+// history on the up and down arrows and the completion of the commands on
+// tab.
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	fd  int
+
+	history  []string
+	complete func(prefix string) []string // the words starting with prefix
+
+	// the line being edited
+	prompt string
+	buf    []rune
+	pos    int
+}
+
+func newLineEditor(in io.Reader, fd int, out io.Writer) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out, fd: fd}
+}
+
+// addHistory adds a line to the history, unless it repeats the last one.
+func (e *lineEditor) addHistory(line string) {
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// readLine reads a line after writing prompt. It returns io.EOF on ctrl-d in
+// an empty line, and errInterrupted on ctrl-c. If the terminal can't be put
+// in raw mode, the line is read without editing.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore()
+
+	e.prompt, e.buf, e.pos = prompt, nil, 0
+	// the history being browsed, the current line is last
+	hist := append(append([]string(nil), e.history...), "")
+	hpos := len(hist) - 1
+	e.refresh()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(e.buf), nil
+		case 3: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // ctrl-d
+			if len(e.buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.delete(e.pos, e.pos+1)
+		case 127, 8: // backspace
+			e.delete(e.pos-1, e.pos)
+		case 1: // ctrl-a
+			e.pos = 0
+		case 5: // ctrl-e
+			e.pos = len(e.buf)
+		case 2: // ctrl-b
+			e.move(-1)
+		case 6: // ctrl-f
+			e.move(1)
+		case 11: // ctrl-k
+			e.delete(e.pos, len(e.buf))
+		case 21: // ctrl-u
+			e.delete(0, e.pos)
+		case 23: // ctrl-w
+			start := e.pos
+			for start > 0 && e.buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && e.buf[start-1] != ' ' {
+				start--
+			}
+			e.delete(start, e.pos)
+		case 12: // ctrl-l
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case '\t':
+			e.completeWord()
+		case 27: // escape sequences of the arrows, home, end and delete
+			seq, err := e.readEscape()
+			if err != nil {
+				return "", err
+			}
+			switch seq {
+			case "[A", "OA":
+				if hpos > 0 {
+					hist[hpos] = string(e.buf)
+					hpos--
+					e.setLine(hist[hpos])
+				}
+			case "[B", "OB":
+				if hpos < len(hist)-1 {
+					hist[hpos] = string(e.buf)
+					hpos++
+					e.setLine(hist[hpos])
+				}
+			case "[C", "OC":
+				e.move(1)
+			case "[D", "OD":
+				e.move(-1)
+			case "[H", "OH", "[1~":
+				e.pos = 0
+			case "[F", "OF", "[4~":
+				e.pos = len(e.buf)
+			case "[3~":
+				e.delete(e.pos, e.pos+1)
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			e.buf = append(e.buf, 0)
+			copy(e.buf[e.pos+1:], e.buf[e.pos:])
+			e.buf[e.pos] = r
+			e.pos++
+		}
+		e.refresh()
+	}
+}
+
+// readEscape reads the rest of an escape sequence, such as "[A".
+func (e *lineEditor) readEscape() (string, error) {
+	b, err := e.in.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if b != '[' && b != 'O' {
+		return string(b), nil
+	}
+	seq := []byte{b}
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		seq = append(seq, b)
+		if b >= '@' && b <= '~' && !(b >= '0' && b <= '9') {
+			return string(seq), nil
+		}
+	}
+}
+
+func (e *lineEditor) setLine(line string) {
+	e.buf = []rune(line)
+	e.pos = len(e.buf)
+}
+
+func (e *lineEditor) move(n int) {
+	if p := e.pos + n; p >= 0 && p <= len(e.buf) {
+		e.pos = p
+	}
+}
+
+// delete deletes the runes in [from, to) of the line.
+func (e *lineEditor) delete(from, to int) {
+	if from < 0 || to > len(e.buf) || from >= to {
+		return
+	}
+	e.buf = append(e.buf[:from], e.buf[to:]...)
+	if e.pos > to {
+		e.pos -= to - from
+	} else if e.pos > from {
+		e.pos = from
+	}
+}
+
+// refresh redraws the line and moves the cursor to its position.
+func (e *lineEditor) refresh() {
+	fmt.Fprintf(e.out, "\r%s%s\x1b[K", e.prompt, string(e.buf))
+	if n := len(e.buf) - e.pos; n > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dD", n)
+	}
+}
+
+// completeWord completes the first word of the line, the command, when the
+// cursor is in it. It lists the candidates when there are many.
+func (e *lineEditor) completeWord() {
+	if e.complete == nil || strings.ContainsRune(string(e.buf[:e.pos]), ' ') {
+		return
+	}
+	prefix := string(e.buf[:e.pos])
+	words := e.complete(prefix)
+	if len(words) == 0 {
+		return
+	}
+	common := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(words) == 1 {
+		common += " "
+	}
+	if common != prefix {
+		rest := []rune(common[len(prefix):])
+		e.buf = append(e.buf[:e.pos], append(rest, e.buf[e.pos:]...)...)
+		e.pos += len(rest)
+		return
+	}
+	sort.Strings(words)
+	fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(words, "  "))
+}
@@ -0,0 +1,191 @@
+// Package export is the export and import subcommands of the moused command.
+package export
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/pkg/logger"
+	"mousedb/service/storage"
+)
+
+// ExportCommand writes the keys of the storage of a node as JSON Lines or CSV.
+type ExportCommand struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewExportCommand returns a new instance of ExportCommand.
+func NewExportCommand() *ExportCommand {
+	return &ExportCommand{
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *ExportCommand) Run(args ...string) error {
+	var configPath, dataDir, format, out, prefix string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "")
+	fs.StringVar(&dataDir, "datadir", "", "")
+	fs.StringVar(&format, "format", storage.FormatJSONL, "")
+	fs.StringVar(&out, "out", "-", "")
+	fs.StringVar(&prefix, "prefix", "", "")
+	fs.Usage = func() { fmt.Fprintln(cmd.Stderr, exportUsage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := parseConfig(configPath, dataDir)
+	if err != nil {
+		return err
+	}
+	// export next to a running node in read only mode
+	s, err := openStorage(config, cmd.Stderr)
+	if errors.Is(err, storage.ErrLocked) {
+		config.Storage.ReadWrite = false
+		s, err = openStorage(config, cmd.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	w := cmd.Stdout
+	if out != "-" {
+		fp, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		w = fp
+	}
+	n, err := s.Export(w, &storage.ExportOptions{Format: format, Prefix: []byte(prefix)})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stderr, "exported %d keys\n", n)
+	return nil
+}
+
+// ImportCommand puts the keys written by ExportCommand into the storage of a node.
+type ImportCommand struct {
+	Stdin  io.Reader
+	Stderr io.Writer
+}
+
+// NewImportCommand returns a new instance of ImportCommand.
+func NewImportCommand() *ImportCommand {
+	return &ImportCommand{
+		Stdin:  os.Stdin,
+		Stderr: os.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *ImportCommand) Run(args ...string) error {
+	var configPath, dataDir, format, in string
+	var batchSize int
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "")
+	fs.StringVar(&dataDir, "datadir", "", "")
+	fs.StringVar(&format, "format", storage.FormatJSONL, "")
+	fs.StringVar(&in, "in", "-", "")
+	fs.IntVar(&batchSize, "batch-size", 1000, "")
+	fs.Usage = func() { fmt.Fprintln(cmd.Stderr, importUsage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := parseConfig(configPath, dataDir)
+	if err != nil {
+		return err
+	}
+	s, err := openStorage(config, cmd.Stderr)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	r := cmd.Stdin
+	if in != "-" {
+		fp, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+		r = fp
+	}
+	start := time.Now()
+	last := start
+	n, err := s.Import(r, &storage.ImportOptions{
+		Format:    format,
+		BatchSize: batchSize,
+		Progress: func(n uint64) {
+			if time.Since(last) >= time.Second {
+				last = time.Now()
+				fmt.Fprintf(cmd.Stderr, "imported %d keys\n", n)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("after %d keys: %w", n, err)
+	}
+	fmt.Fprintf(cmd.Stderr, "imported %d keys in %s\n", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func parseConfig(configPath, dataDir string) (*run.Config, error) {
+	config, err := run.NewCommand().ParseConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("parse config: %s", err)
+	}
+	if dataDir != "" {
+		config.Storage.Dir = dataDir
+	}
+	config.Storage.OpenTimeoutSecs = 0
+	config.Storage.MergeSecs = 0
+	config.Storage.RefreshSecs = 0
+	return config, nil
+}
+
+func openStorage(config *run.Config, stderr io.Writer) (*storage.Storage, error) {
+	s := storage.New(&config.Storage)
+	s.WithLogger(logger.New(stderr))
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+const exportUsage = `Writes the keys of the storage with their values as JSON Lines or CSV.
+Usage: moused export [flags]
+    -config <path>
+            Set the path to the configuration file.
+    -datadir <path>
+            Export the storage in this directory instead of the configured one.
+    -format <jsonl|csv>
+            The format of the export, jsonl by default.
+    -out <path>
+            Write the export to this new file instead of stdout.
+    -prefix <prefix>
+            Only export the keys starting with prefix.`
+
+const importUsage = `Puts the keys written by "moused export" into the storage, the node must be stopped.
+Usage: moused import [flags]
+    -config <path>
+            Set the path to the configuration file.
+    -datadir <path>
+            Import into the storage in this directory instead of the configured one.
+    -format <jsonl|csv>
+            The format of the input, jsonl by default.
+    -in <path>
+            Read the input from this file instead of stdin.
+    -batch-size <n>
+            The number of keys written at once, 1000 by default.`
@@ -33,7 +33,12 @@ Usage: moused [[command] [arguments]]
 
 The commands are:
 	
+	backup               write a backup of the storage
+	cli                  open a shell on a running server
+	export               write the keys as JSON Lines or CSV
 	help                 display this help message
+	import               put the keys written by export
+	restore              restore the storage from a backup
 	run                  run node with existing configuration
 	config               display the default configuration
 	version              displays the MouseDB version
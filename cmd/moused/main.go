@@ -11,7 +11,11 @@ import (
 	"time"
 
 	"mousedb/cmd"
+	"mousedb/cmd/moused/backup"
+	"mousedb/cmd/moused/cli"
+	"mousedb/cmd/moused/export"
 	"mousedb/cmd/moused/help"
+	"mousedb/cmd/moused/restore"
 	"mousedb/cmd/moused/run"
 )
 
@@ -90,9 +94,29 @@ func (m *Main) Run(args ...string) error {
 		// Block again until another signal is received, a shutdown timeout elapses,
 		// or the Command is gracefully closed
 		cmd.Logger.Info("Waiting for clean shutdown...")
+	case "backup":
+		if err := backup.NewCommand().Run(args...); err != nil {
+			return fmt.Errorf("backup: %s", err)
+		}
+	case "cli":
+		if err := cli.NewCommand().Run(args...); err != nil {
+			return fmt.Errorf("cli: %s", err)
+		}
+	case "export":
+		if err := export.NewExportCommand().Run(args...); err != nil {
+			return fmt.Errorf("export: %s", err)
+		}
+	case "import":
+		if err := export.NewImportCommand().Run(args...); err != nil {
+			return fmt.Errorf("import: %s", err)
+		}
+	case "restore":
+		if err := restore.NewCommand().Run(args...); err != nil {
+			return fmt.Errorf("restore: %s", err)
+		}
 	case "version":
 		if err := NewVersionCommand().Run(args...); err != nil {
-			fmt.Errorf("version: %s", err)
+			return fmt.Errorf("version: %s", err)
 		}
 	case "help":
 		if err := help.NewCommand().Run(args...); err != nil {
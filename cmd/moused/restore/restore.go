@@ -0,0 +1,110 @@
+// Package restore is the restore subcommand of the moused command.
+package restore
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"mousedb/cmd/moused/run"
+	"mousedb/pkg/logger"
+	"mousedb/service/storage"
+)
+
+// Command restores the storage of a node from a backup.
+type Command struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewCommand returns a new instance of Command.
+func NewCommand() *Command {
+	return &Command{
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+}
+
+// Run executes the command.
+func (cmd *Command) Run(args ...string) error {
+	var configPath, dataDir, dir, in, until string
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.StringVar(&configPath, "config", "", "")
+	fs.StringVar(&dataDir, "datadir", "", "")
+	fs.StringVar(&dir, "dir", "", "")
+	fs.StringVar(&in, "in", "", "")
+	fs.StringVar(&until, "until", "", "")
+	fs.Usage = func() { fmt.Fprintln(cmd.Stderr, usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if (dir == "") == (in == "") {
+		fs.Usage()
+		return fmt.Errorf("one of -dir and -in is required")
+	}
+
+	config, err := run.NewCommand().ParseConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("parse config: %s", err)
+	}
+	if dataDir != "" {
+		config.Storage.Dir = dataDir
+	}
+	opts := &storage.RestoreOptions{Logger: logger.New(cmd.Stderr)}
+	if until != "" {
+		if opts.Until, err = parseTime(until); err != nil {
+			return err
+		}
+	}
+
+	var manifest *storage.BackupManifest
+	switch {
+	case dir != "":
+		manifest, err = storage.RestoreDir(dir, config.Storage.Dir, opts)
+	case in == "-":
+		manifest, err = storage.Restore(cmd.Stdin, config.Storage.Dir, opts)
+	default:
+		var fp *os.File
+		if fp, err = os.Open(in); err != nil {
+			return err
+		}
+		defer fp.Close()
+		manifest, err = storage.Restore(fp, config.Storage.Dir, opts)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cmd.Stdout, "restored %d files into %s\n", len(manifest.Files), config.Storage.Dir)
+	return nil
+}
+
+// parseTime parses an RFC 3339 time or unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -until %q, want RFC 3339 or unix seconds", s)
+	}
+	return t, nil
+}
+
+const usage = `Restores the storage from a backup into a new or empty data directory.
+Usage: moused restore [flags]
+    -config <path>
+            Set the path to the configuration file.
+    -datadir <path>
+            Restore into this directory instead of the configured one.
+    -dir <path>
+            Restore the backup written into this directory.
+    -in <path>
+            Restore the backup tar file, or read it from stdin when path is -.
+    -until <time>
+            Keep only the records written at or before this time, given
+            in RFC 3339 or unix seconds.`
@@ -2,6 +2,8 @@ package run
 
 import (
 	"mousedb/pkg/logger"
+	"mousedb/service/httpd"
+	"mousedb/service/memcached"
 	"mousedb/service/storage"
 )
 
@@ -17,6 +19,10 @@ type Config struct {
 	Logging logger.Config `toml:"logging" json:"logging"`
 
 	Storage storage.Config `toml:"storage"`
+
+	HTTPD httpd.Config `toml:"http" json:"http"`
+
+	Memcached memcached.Config `toml:"memcached" json:"memcached"`
 }
 
 func (c *Config) Validate() error {
@@ -24,6 +30,12 @@ func (c *Config) Validate() error {
 	if err := c.Storage.Validate(); err != nil {
 		return err
 	}
+	if err := c.HTTPD.Validate(); err != nil {
+		return err
+	}
+	if err := c.Memcached.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -32,6 +44,10 @@ func NewConfig() *Config {
 	c := &Config{}
 	c.BindAddress = DefaultBindAddress
 	c.Logging = logger.NewConfig()
+	c.Storage = *storage.NewConfig()
+	c.Storage.DefaultDir()
+	c.HTTPD = httpd.NewConfig()
+	c.Memcached = memcached.NewConfig()
 
 	return c
 }
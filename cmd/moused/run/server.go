@@ -9,6 +9,9 @@ import (
 	"runtime/pprof"
 	"time"
 
+	"mousedb/service/httpd"
+	"mousedb/service/memcached"
+	"mousedb/service/resp"
 	"mousedb/service/storage"
 
 	"go.uber.org/zap"
@@ -60,9 +63,26 @@ type Service interface {
 // Err returns an error channel that multiplexes all out of band errors received from all services.
 func (s *Server) Err() <-chan error { return s.err }
 
+// Close closes the services in reverse order and the listener.
 func (s *Server) Close() error {
+	select {
+	case <-s.closing:
+		return nil
+	default:
+	}
 	close(s.closing)
-	return nil
+
+	var err error
+	for i := len(s.Services) - 1; i >= 0; i-- {
+		if cerr := s.Services[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if s.Listener != nil {
+		// the resp service closes it first
+		s.Listener.Close()
+	}
+	return err
 }
 
 // NewServer returns a new instance of Server built from a config.
@@ -78,6 +98,7 @@ func NewServer(c *Config, buildInfo *BuildInfo) (*Server, error) {
 		err:         make(chan error),
 		closing:     make(chan struct{}),
 		BindAddress: bind,
+		Logger:      zap.NewNop(),
 		config:      c,
 	}
 
@@ -102,17 +123,55 @@ func (s *Server) Open() error {
 
 	//TODO 设置路由
 	//TODO 装载服务
-	s.appendStorage(&s.config.Storage)
+	st := s.appendStorage(&s.config.Storage)
+	s.appendRESPService(st)
+	s.appendHTTPDService(st)
+	s.appendMemcachedService(st)
 	//TODO 启动服务
-	for _, service := range s.Services {
-		service.Open()
+	for i, service := range s.Services {
+		service.WithLogger(s.Logger)
+		if err := service.Open(); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				s.Services[j].Close()
+			}
+			ln.Close()
+			return fmt.Errorf("open service: %s", err)
+		}
 	}
 	return nil
 }
 
-func (s *Server) appendStorage(c *storage.Config) {
+func (s *Server) appendStorage(c *storage.Config) *storage.Storage {
 	storage := storage.New(c)
 	s.Services = append(s.Services, storage)
+	return storage
+}
+
+// appendRESPService serves st over RESP on the shared listener.
+func (s *Server) appendRESPService(st *storage.Storage) {
+	srv := resp.NewService(s.Listener, st)
+	srv.Version = s.BuildInfo.Version
+	s.Services = append(s.Services, srv)
+}
+
+// appendHTTPDService serves st over HTTP on its own bind address.
+func (s *Server) appendHTTPDService(st *storage.Storage) {
+	if !s.config.HTTPD.Enabled {
+		return
+	}
+	srv := httpd.NewService(s.config.HTTPD, st)
+	s.Services = append(s.Services, srv)
+}
+
+// appendMemcachedService serves st over the memcached protocol on its own
+// bind address, if it is enabled.
+func (s *Server) appendMemcachedService(st *storage.Storage) {
+	if !s.config.Memcached.Enabled {
+		return
+	}
+	srv := memcached.NewService(s.config.Memcached, st)
+	srv.Version = s.BuildInfo.Version
+	s.Services = append(s.Services, srv)
 }
 
 // prof stores the file locations of active profiles.
@@ -0,0 +1,116 @@
+// Package server accepts the connections of the services which speak a
+// protocol over TCP, and keeps track of them until they are closed.
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Server accepts the connections of a listener and serves each of them in
+// its own goroutine.
+type Server struct {
+	ln     net.Listener
+	handle func(nc net.Conn)
+	log    *zap.Logger
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Serve starts accepting the connections of ln, and calls handle with every
+// one of them in its own goroutine. handle closes its connection.
+func Serve(ln net.Listener, log *zap.Logger, handle func(nc net.Conn)) *Server {
+	s := &Server{
+		ln:      ln,
+		handle:  handle,
+		log:     log,
+		conns:   make(map[net.Conn]struct{}),
+		closing: make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their handlers to return.
+func (s *Server) Close() error {
+	select {
+	case <-s.closing:
+		return nil
+	default:
+	}
+	close(s.closing)
+	err := s.ln.Close()
+	s.mu.Lock()
+	for nc := range s.conns {
+		nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// Conns returns the number of open connections.
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// serve accepts the connections until the server is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	var delay time.Duration
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.closing:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				// running out of file descriptors, retry after a while
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.log.Warn("accept failed", zap.Error(err), zap.Duration("retry_in", delay))
+				time.Sleep(delay)
+				continue
+			}
+			s.log.Error("accept failed, stop listening", zap.Error(err))
+			return
+		}
+		delay = 0
+
+		s.mu.Lock()
+		select {
+		case <-s.closing:
+			s.mu.Unlock()
+			nc.Close()
+			return
+		default:
+		}
+		s.conns[nc] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(nc)
+			s.mu.Lock()
+			delete(s.conns, nc)
+			s.mu.Unlock()
+		}()
+	}
+}
@@ -0,0 +1,35 @@
+package httpd
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// DefaultBindAddress is the default address the HTTP service binds to.
+	DefaultBindAddress = "127.0.0.1:8063"
+)
+
+// Config represents the configuration of the HTTP service.
+type Config struct {
+	Enabled     bool   `toml:"enabled" json:"enabled"`
+	BindAddress string `toml:"bind-address" json:"bind-address,omitempty"`
+}
+
+// NewConfig returns a new Config with the defaults, the service is disabled.
+func NewConfig() Config {
+	return Config{
+		BindAddress: DefaultBindAddress,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.BindAddress); err != nil {
+		return fmt.Errorf("HTTP bind-address %q: %v", c.BindAddress, err)
+	}
+	return nil
+}
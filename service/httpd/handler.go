@@ -0,0 +1,397 @@
+package httpd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	kvPath     = "/v1/kv/"
+	bulkPath   = "/v1/bulk/"
+	backupPath = "/v1/backup"
+
+	// the largest bulk request body
+	maxBulkBody = 64 << 20
+)
+
+var (
+	errBadKey      = errors.New("missing key")
+	errBadTTL      = errors.New("ttl must be an integer number of seconds")
+	errBadEncoding = errors.New(`encoding must be "" or "base64"`)
+	errTooLarge    = errors.New("request body too large")
+)
+
+// badRequest is an error of the client.
+type badRequest struct{ err error }
+
+func (e badRequest) Error() string { return e.err.Error() }
+func (e badRequest) Unwrap() error { return e.err }
+
+// Handler serves the REST API of the storage:
+//
+//	GET    /v1/kv/{key}       the raw value, its version in X-Mousedb-Version
+//	HEAD   /v1/kv/{key}       200 if the key exists, 404 otherwise
+//	PUT    /v1/kv/{key}?ttl=n set the value to the body, expiring after n seconds
+//	DELETE /v1/kv/{key}       delete the key
+//	POST   /v1/bulk/get       get keys:   {"keys": [...]}
+//	POST   /v1/bulk/put       put items:  {"items": [{"key", "value", "ttl"}]}
+//	POST   /v1/bulk/delete    delete keys: {"keys": [...]}
+//	GET    /v1/backup         a backup as the tar stream of storage.Backup
+//
+// The key in the path is escaped. The keys and values of the bulk requests
+// are text, or base64 when "encoding" is "base64", and the replies use the
+// encoding of the request. The errors are JSON bodies: {"error": "..."}.
+type Handler struct {
+	Storage *storage.Storage
+	Logger  *zap.Logger
+}
+
+// NewHandler returns a new Handler serving s.
+func NewHandler(s *storage.Storage) *Handler {
+	return &Handler{
+		Storage: s,
+		Logger:  zap.NewNop(),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.EscapedPath()
+	switch {
+	case strings.HasPrefix(path, kvPath):
+		key, err := url.PathUnescape(path[len(kvPath):])
+		if err != nil || key == "" {
+			h.httpError(w, r, badRequest{errBadKey})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.serveGet(w, r, []byte(key))
+		case http.MethodPut:
+			h.servePut(w, r, []byte(key))
+		case http.MethodDelete:
+			h.serveDelete(w, r, []byte(key))
+		default:
+			h.methodNotAllowed(w, r, "GET, HEAD, PUT, DELETE")
+		}
+	case strings.HasPrefix(path, bulkPath):
+		if r.Method != http.MethodPost {
+			h.methodNotAllowed(w, r, "POST")
+			return
+		}
+		switch path[len(bulkPath):] {
+		case "get":
+			h.serveBulkGet(w, r)
+		case "put":
+			h.serveBulkPut(w, r)
+		case "delete":
+			h.serveBulkDelete(w, r)
+		default:
+			h.jsonError(w, http.StatusNotFound, "not found")
+		}
+	case path == backupPath:
+		if r.Method != http.MethodGet {
+			h.methodNotAllowed(w, r, "GET")
+			return
+		}
+		h.serveBackup(w, r)
+	default:
+		h.jsonError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// serveBackup streams a backup of the storage. A failure once the stream has
+// started aborts the connection, so the client sees the stream cut short.
+func (h *Handler) serveBackup(w http.ResponseWriter, r *http.Request) {
+	cw := &countWriter{w: w}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if _, err := h.Storage.Backup(cw); err != nil {
+		if cw.n == 0 {
+			h.httpError(w, r, err)
+			return
+		}
+		h.Logger.Error("backup failed", zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (h *Handler) serveGet(w http.ResponseWriter, r *http.Request, key []byte) {
+	value, version, err := h.Storage.GetWithVersion(key)
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.Header().Set("X-Mousedb-Version", strconv.FormatUint(version, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(value)
+	}
+}
+
+func (h *Handler) servePut(w http.ResponseWriter, r *http.Request, key []byte) {
+	ttl, hasTTL, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	limit := int64(h.Storage.Config.ValueMaxSize)
+	if limit <= 0 {
+		limit = maxBulkBody
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	if err != nil {
+		h.httpError(w, r, bodyError(err))
+		return
+	}
+	if hasTTL {
+		err = h.Storage.PutWithTTL(key, value, ttl)
+	} else {
+		err = h.Storage.Put(key, value)
+	}
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveDelete(w http.ResponseWriter, r *http.Request, key []byte) {
+	if err := h.Storage.Del(key); err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// bulkRequest is the body of the bulk requests.
+type bulkRequest struct {
+	Encoding string     `json:"encoding,omitempty"`
+	Keys     []string   `json:"keys,omitempty"`
+	Items    []bulkItem `json:"items,omitempty"`
+}
+
+// bulkItem is a key of a bulk request or reply.
+type bulkItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	TTL   *int64 `json:"ttl,omitempty"`   // put: seconds until the key expires, the default expiry if unset
+	Found *bool  `json:"found,omitempty"` // get: whether the key exists
+}
+
+// bulkReply is the reply of the bulk requests.
+type bulkReply struct {
+	Encoding string     `json:"encoding,omitempty"`
+	Items    []bulkItem `json:"items,omitempty"`
+	Count    int        `json:"count"`
+}
+
+func (h *Handler) serveBulkGet(w http.ResponseWriter, r *http.Request) {
+	req, err := readBulkRequest(w, r)
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	reply := bulkReply{Encoding: req.Encoding, Items: make([]bulkItem, len(req.Keys))}
+	for i, k := range req.Keys {
+		key, err := decode(req.Encoding, k)
+		if err != nil {
+			h.httpError(w, r, err)
+			return
+		}
+		value, err := h.Storage.Get(key)
+		if err != nil && err != storage.ErrNotFound {
+			h.httpError(w, r, err)
+			return
+		}
+		found := err == nil
+		reply.Items[i] = bulkItem{Key: k, Value: encode(req.Encoding, value), Found: &found}
+		if found {
+			reply.Count++
+		}
+	}
+	h.writeJSON(w, http.StatusOK, reply)
+}
+
+// serveBulkPut writes the items at once in a batch.
+func (h *Handler) serveBulkPut(w http.ResponseWriter, r *http.Request) {
+	req, err := readBulkRequest(w, r)
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	b := storage.NewBatch()
+	for _, item := range req.Items {
+		key, err := decode(req.Encoding, item.Key)
+		if err != nil {
+			h.httpError(w, r, err)
+			return
+		}
+		value, err := decode(req.Encoding, item.Value)
+		if err != nil {
+			h.httpError(w, r, err)
+			return
+		}
+		if len(key) == 0 {
+			h.httpError(w, r, badRequest{errBadKey})
+			return
+		}
+		if item.TTL != nil {
+			b.PutWithTTL(key, value, time.Duration(*item.TTL)*time.Second)
+		} else {
+			b.Put(key, value)
+		}
+	}
+	if err := h.Storage.Write(b); err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, bulkReply{Count: b.Len()})
+}
+
+// serveBulkDelete deletes the keys at once in a batch, and replies how many
+// existed.
+func (h *Handler) serveBulkDelete(w http.ResponseWriter, r *http.Request) {
+	req, err := readBulkRequest(w, r)
+	if err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	b := storage.NewBatch()
+	for _, k := range req.Keys {
+		key, err := decode(req.Encoding, k)
+		if err != nil {
+			h.httpError(w, r, err)
+			return
+		}
+		if _, err := h.Storage.TTL(key); err == nil {
+			b.Del(key)
+		}
+	}
+	if err := h.Storage.Write(b); err != nil {
+		h.httpError(w, r, err)
+		return
+	}
+	h.writeJSON(w, http.StatusOK, bulkReply{Count: b.Len()})
+}
+
+func readBulkRequest(w http.ResponseWriter, r *http.Request) (*bulkRequest, error) {
+	var req bulkRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		return nil, bodyError(err)
+	}
+	if req.Encoding != "" && req.Encoding != "base64" {
+		return nil, badRequest{errBadEncoding}
+	}
+	return &req, nil
+}
+
+// parseTTL parses a ttl in seconds, a ttl <= 0 never expires.
+func parseTTL(s string) (time.Duration, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return 0, false, badRequest{errBadTTL}
+	}
+	return time.Duration(n) * time.Second, true, nil
+}
+
+func decode(encoding, s string) ([]byte, error) {
+	if encoding == "" {
+		return []byte(s), nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, badRequest{fmt.Errorf("decode base64: %w", err)}
+	}
+	return b, nil
+}
+
+func encode(encoding string, b []byte) string {
+	if encoding == "" {
+		return string(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// bodyError returns the error reading a request body as an error of the client.
+func bodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errTooLarge
+	}
+	return badRequest{err}
+}
+
+// httpError replies err with the status it maps to.
+func (h *Handler) httpError(w http.ResponseWriter, r *http.Request, err error) {
+	var bad badRequest
+	code := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &bad):
+		code = http.StatusBadRequest
+	case errors.Is(err, errTooLarge):
+		code = http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, storage.ErrReadOnly):
+		code = http.StatusForbidden
+	case errors.Is(err, storage.ErrClosed):
+		code = http.StatusServiceUnavailable
+	}
+	if code == http.StatusInternalServerError {
+		h.Logger.Error("request failed", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(code)
+		return
+	}
+	h.jsonError(w, code, err.Error())
+}
+
+func (h *Handler) methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	h.jsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func (h *Handler) jsonError(w http.ResponseWriter, code int, msg string) {
+	h.writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func (h *Handler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		h.Logger.Debug("write reply failed", zap.Error(err))
+	}
+}
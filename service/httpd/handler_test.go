@@ -0,0 +1,134 @@
+package httpd
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"mousedb/pkg/assert"
+	"mousedb/service/storage"
+)
+
+func openTestServer(t *testing.T) *httptest.Server {
+	c := storage.NewConfig()
+	c.Dir = t.TempDir()
+	c.MergeSecs = 0
+	c.ValueMaxSize = 16
+	st := storage.New(c)
+	assert.Nil(t, st.Open())
+	ts := httptest.NewServer(NewHandler(st))
+	t.Cleanup(func() {
+		ts.Close()
+		assert.Nil(t, st.Close())
+	})
+	return ts
+}
+
+// do sends a request and returns the status and body of the reply.
+func do(t *testing.T, ts *httptest.Server, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	assert.Nil(t, err)
+	resp, err := ts.Client().Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestHandlerKV(t *testing.T) {
+	ts := openTestServer(t)
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+		reply              string
+	}{
+		{"GET", "/v1/kv/foo", "", 404, `{"error":"not Found"}`},
+		{"HEAD", "/v1/kv/foo", "", 404, ""},
+		{"PUT", "/v1/kv/foo", "bar", 204, ""},
+		{"GET", "/v1/kv/foo", "", 200, "bar"},
+		{"HEAD", "/v1/kv/foo", "", 200, ""},
+		{"PUT", "/v1/kv/a%2Fb", "slash", 204, ""},
+		{"GET", "/v1/kv/a%2Fb", "", 200, "slash"},
+		{"PUT", "/v1/kv/foo?ttl=x", "bar", 400, `{"error":"ttl must be an integer number of seconds"}`},
+		{"PUT", "/v1/kv/foo", strings.Repeat("x", 17), 413, `{"error":"request body too large"}`},
+		{"PUT", "/v1/kv/", "bar", 400, `{"error":"missing key"}`},
+		{"POST", "/v1/kv/foo", "", 405, `{"error":"method not allowed"}`},
+		{"DELETE", "/v1/kv/foo", "", 204, ""},
+		{"DELETE", "/v1/kv/foo", "", 404, `{"error":"not Found"}`},
+		{"GET", "/v2", "", 404, `{"error":"not found"}`},
+	} {
+		code, reply := do(t, ts, tc.method, tc.path, tc.body)
+		assert.Equal(t, tc.code, code)
+		assert.Equal(t, tc.reply, reply)
+	}
+}
+
+func TestHandlerBulk(t *testing.T) {
+	ts := openTestServer(t)
+	code, reply := do(t, ts, "POST", "/v1/bulk/put", `{"items":[{"key":"a","value":"1"},{"key":"b","value":"2","ttl":100}]}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"count":2}`, reply)
+
+	// binary keys and values are base64
+	code, reply = do(t, ts, "POST", "/v1/bulk/put", `{"encoding":"base64","items":[{"key":"/w==","value":"AAE="}]}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"count":1}`, reply)
+
+	code, reply = do(t, ts, "POST", "/v1/bulk/get", `{"keys":["a","b","c"]}`)
+	assert.Equal(t, 200, code)
+	var got bulkReply
+	assert.Nil(t, json.Unmarshal([]byte(reply), &got))
+	assert.Equal(t, 2, got.Count)
+	assert.Equal(t, 3, len(got.Items))
+	assert.Equal(t, "1", got.Items[0].Value)
+	assert.Equal(t, "2", got.Items[1].Value)
+	assert.T(t, !*got.Items[2].Found)
+
+	code, reply = do(t, ts, "POST", "/v1/bulk/get", `{"encoding":"base64","keys":["/w=="]}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"encoding":"base64","items":[{"key":"/w==","value":"AAE=","found":true}],"count":1}`, reply)
+
+	code, reply = do(t, ts, "POST", "/v1/bulk/delete", `{"keys":["a","c"]}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"count":1}`, reply)
+
+	code, _ = do(t, ts, "POST", "/v1/bulk/get", `{"encoding":"hex","keys":["a"]}`)
+	assert.Equal(t, 400, code)
+	code, _ = do(t, ts, "POST", "/v1/bulk/get", `{"keys":`)
+	assert.Equal(t, 400, code)
+	code, _ = do(t, ts, "GET", "/v1/bulk/get", "")
+	assert.Equal(t, 405, code)
+}
+
+func TestHandlerBackup(t *testing.T) {
+	ts := openTestServer(t)
+	code, _ := do(t, ts, "PUT", "/v1/kv/foo", "bar")
+	assert.Equal(t, 204, code)
+
+	resp, err := ts.Client().Get(ts.URL + "/v1/backup")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "application/x-tar", resp.Header.Get("Content-Type"))
+	tr := tar.NewReader(resp.Body)
+	var names []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, true, len(names) > 1)
+	assert.Equal(t, storage.BackupManifestName, names[len(names)-1])
+
+	code, reply := do(t, ts, "POST", "/v1/backup", "")
+	assert.Equal(t, 405, code)
+	assert.Equal(t, `{"error":"method not allowed"}`, reply)
+}
@@ -0,0 +1,85 @@
+// Package httpd serves the storage over HTTP, as a REST API of JSON and raw
+// values.
+package httpd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+// Service serves the REST API of Handler on its own listener.
+type Service struct {
+	Listener net.Listener
+	Handler  *Handler
+
+	Logger *zap.Logger
+
+	addr   string
+	server *http.Server
+	done   chan struct{}
+}
+
+// NewService returns a new Service serving s on the bind address of c.
+func NewService(c Config, s *storage.Storage) *Service {
+	return &Service{
+		Handler: NewHandler(s),
+		Logger:  zap.NewNop(),
+		addr:    c.BindAddress,
+	}
+}
+
+// WithLogger sets the logger for the service.
+func (s *Service) WithLogger(log *zap.Logger) {
+	s.Logger = log.With(zap.String("service", "httpd"))
+	s.Handler.Logger = s.Logger
+}
+
+// Open listens on the bind address, unless Listener is already set, and
+// starts serving.
+func (s *Service) Open() error {
+	if s.Listener == nil {
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.Listener = ln
+	}
+	s.server = &http.Server{
+		Handler:           s.Handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          zap.NewStdLog(s.Logger),
+	}
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.server.Serve(s.Listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.Logger.Error("serve HTTP failed", zap.Error(err))
+		}
+	}()
+	s.Logger.Info("listening for HTTP requests", zap.String("addr", s.Listener.Addr().String()))
+	return nil
+}
+
+// Close closes the listener and the open connections.
+func (s *Service) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	<-s.done
+	return err
+}
+
+// Addr returns the address the service listens on, nil before Open.
+func (s *Service) Addr() net.Addr {
+	if s.Listener == nil {
+		return nil
+	}
+	return s.Listener.Addr()
+}
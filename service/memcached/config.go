@@ -0,0 +1,35 @@
+package memcached
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// DefaultBindAddress is the default address the memcached service binds to.
+	DefaultBindAddress = "127.0.0.1:11211"
+)
+
+// Config represents the configuration of the memcached service.
+type Config struct {
+	Enabled     bool   `toml:"enabled" json:"enabled"`
+	BindAddress string `toml:"bind-address" json:"bind-address,omitempty"`
+}
+
+// NewConfig returns a new Config with the defaults, the service is disabled.
+func NewConfig() Config {
+	return Config{
+		BindAddress: DefaultBindAddress,
+	}
+}
+
+// Validate returns an error if the config is invalid.
+func (c Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.BindAddress); err != nil {
+		return fmt.Errorf("memcached bind-address %q: %v", c.BindAddress, err)
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	maxLineLen   = 64 << 10 // the longest command line
+	defaultLimit = 1 << 20  // the largest value when storage.Config.ValueMaxSize is 0
+)
+
+var (
+	errLineTooLong = errors.New("line too long")
+	errBadLine     = errors.New("bad command line format")
+)
+
+// conn is a client connection.
+type conn struct {
+	s  *Service
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+
+	noreply bool // the current command asked for no reply
+	quit    bool
+}
+
+func newConn(s *Service, nc net.Conn) *conn {
+	return &conn{
+		s:  s,
+		nc: nc,
+		r:  bufio.NewReaderSize(nc, 16<<10),
+		w:  bufio.NewWriterSize(nc, 16<<10),
+	}
+}
+
+// serve runs the commands of the client until it quits. The replies are
+// flushed when no more command is buffered, so a pipeline is answered with a
+// single write.
+func (c *conn) serve() {
+	defer c.nc.Close()
+	for !c.quit {
+		line, err := c.readLine()
+		if err == errLineTooLong {
+			c.clientError(err.Error())
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				c.s.Logger.Debug("read a command failed", zap.String("addr", c.nc.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+		if err := c.run(bytes.Fields(line)); err != nil {
+			c.s.Logger.Debug("read a value failed", zap.String("addr", c.nc.RemoteAddr().String()), zap.Error(err))
+			return
+		}
+		if c.r.Buffered() == 0 {
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	c.w.Flush()
+}
+
+// readLine reads a line without its CRLF.
+func (c *conn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(line) > maxLineLen {
+			return nil, errLineTooLong
+		}
+	}
+	return bytes.TrimRight(line, "\r\n"), nil
+}
+
+// run runs a command and writes its reply. It only returns the errors
+// reading the client, which close the connection.
+func (c *conn) run(args [][]byte) error {
+	c.noreply = false
+	if len(args) == 0 {
+		c.reply("ERROR")
+		return nil
+	}
+	switch string(args[0]) {
+	case "get", "gets":
+		c.get(args)
+	case "set", "add", "replace", "cas":
+		return c.store(args)
+	case "delete":
+		c.delete(args)
+	case "incr", "decr":
+		c.incr(args)
+	case "touch":
+		c.touch(args)
+	case "version":
+		c.reply("VERSION " + c.s.Version)
+	case "verbosity":
+		c.noreply = len(args) > 2 && string(args[2]) == "noreply"
+		c.reply("OK")
+	case "quit":
+		c.quit = true
+	default:
+		c.reply("ERROR")
+	}
+	return nil
+}
+
+func (c *conn) reply(s string) {
+	if c.noreply {
+		return
+	}
+	c.w.WriteString(s)
+	c.w.WriteString("\r\n")
+}
+
+func (c *conn) clientError(msg string) {
+	c.w.WriteString("CLIENT_ERROR " + msg + "\r\n")
+}
+
+func (c *conn) serverError(err error) {
+	if errors.Is(err, storage.ErrReadOnly) {
+		c.w.WriteString("SERVER_ERROR storage is read only\r\n")
+		return
+	}
+	c.w.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+}
+
+// parseNoreply sets noreply if the optional last argument at i is "noreply".
+func (c *conn) parseNoreply(args [][]byte, i int) bool {
+	switch {
+	case len(args) == i:
+		return true
+	case len(args) == i+1 && string(args[i]) == "noreply":
+		c.noreply = true
+		return true
+	}
+	return false
+}
+
+// get replies the values of the keys: get|gets <key>*.
+func (c *conn) get(args [][]byte) {
+	if len(args) < 2 {
+		c.reply("ERROR")
+		return
+	}
+	gets := string(args[0]) == "gets"
+	for _, key := range args[1:] {
+		if !validKey(key) {
+			c.clientError(errBadLine.Error())
+			return
+		}
+	}
+	for _, key := range args[1:] {
+		data, flags, version, err := c.s.Storage.GetWithMeta(key)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			c.serverError(err)
+			return
+		}
+		c.w.WriteString("VALUE ")
+		c.w.Write(key)
+		c.w.WriteByte(' ')
+		c.w.WriteString(strconv.FormatUint(uint64(flags), 10))
+		c.w.WriteByte(' ')
+		c.w.WriteString(strconv.Itoa(len(data)))
+		if gets {
+			c.w.WriteByte(' ')
+			c.w.WriteString(strconv.FormatUint(version, 10))
+		}
+		c.w.WriteString("\r\n")
+		c.w.Write(data)
+		c.w.WriteString("\r\n")
+	}
+	c.w.WriteString("END\r\n")
+}
+
+// store runs a storage command:
+//
+//	set|add|replace <key> <flags> <exptime> <bytes> [noreply]
+//	cas <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+func (c *conn) store(args [][]byte) error {
+	name := string(args[0])
+	n := 5
+	if name == "cas" {
+		n = 6
+	}
+	if len(args) < n || !validKey(args[1]) || !c.parseNoreply(args, n) {
+		c.noreply = false
+		c.clientError(errBadLine.Error())
+		return nil
+	}
+	key := args[1]
+	flags, err1 := strconv.ParseUint(string(args[2]), 10, 32)
+	ttl, expired, err2 := parseExptime(args[3])
+	size, err3 := strconv.Atoi(string(args[4]))
+	var cas uint64
+	var err4 error
+	if name == "cas" {
+		cas, err4 = strconv.ParseUint(string(args[5]), 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || size < 0 {
+		c.noreply = false
+		c.clientError(errBadLine.Error())
+		return nil
+	}
+
+	limit := int(c.s.Storage.Config.ValueMaxSize)
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if size > limit {
+		// skip the data
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return err
+		}
+		c.w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		return nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		c.noreply = false
+		c.clientError("bad data chunk")
+		// skip the rest of the data line
+		if data[size+1] != '\n' {
+			_, err := c.readLine()
+			return err
+		}
+		return nil
+	}
+	data = data[:size]
+	it := &item{data: data, flags: uint32(flags), ttl: ttl, expired: expired}
+
+	var err error
+	if name == "set" {
+		if expired {
+			err = c.s.Storage.Del(key)
+			if err == storage.ErrNotFound {
+				err = nil
+			}
+		} else {
+			_, err = c.s.Storage.PutWithMeta(key, it.data, it.flags, it.ttl)
+		}
+		if err != nil {
+			c.serverError(err)
+			return nil
+		}
+		c.reply("STORED")
+		return nil
+	}
+
+	reply := "STORED"
+	err = c.update(key, func(old *item) *item {
+		switch {
+		case name == "add" && old != nil:
+			reply = "NOT_STORED"
+		case name == "replace" && old == nil:
+			reply = "NOT_STORED"
+		case name == "cas" && old == nil:
+			reply = "NOT_FOUND"
+		case name == "cas" && old.version != cas:
+			reply = "EXISTS"
+		default:
+			reply = "STORED"
+			return it
+		}
+		return nil
+	})
+	if err != nil {
+		c.serverError(err)
+		return nil
+	}
+	c.reply(reply)
+	return nil
+}
+
+// delete deletes a key: delete <key> [noreply].
+func (c *conn) delete(args [][]byte) {
+	if len(args) < 2 || !validKey(args[1]) || !c.parseNoreply(args, 2) {
+		c.noreply = false
+		c.clientError(errBadLine.Error())
+		return
+	}
+	switch err := c.s.Storage.Del(args[1]); err {
+	case nil:
+		c.reply("DELETED")
+	case storage.ErrNotFound:
+		c.reply("NOT_FOUND")
+	default:
+		c.serverError(err)
+	}
+}
+
+// incr adds to or subtracts from a decimal value: incr|decr <key> <value>
+// [noreply]. An increment wraps around at 64 bits, a decrement stops at 0.
+func (c *conn) incr(args [][]byte) {
+	if len(args) < 3 || !validKey(args[1]) || !c.parseNoreply(args, 3) {
+		c.noreply = false
+		c.clientError(errBadLine.Error())
+		return
+	}
+	delta, err := strconv.ParseUint(string(args[2]), 10, 64)
+	if err != nil {
+		c.noreply = false
+		c.clientError("invalid numeric delta argument")
+		return
+	}
+	decr := string(args[0]) == "decr"
+	reply := "NOT_FOUND"
+	err = c.update(args[1], func(old *item) *item {
+		if old == nil {
+			reply = "NOT_FOUND"
+			return nil
+		}
+		n, err := strconv.ParseUint(string(bytes.TrimRight(old.data, " ")), 10, 64)
+		if err != nil {
+			reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+			return nil
+		}
+		switch {
+		case !decr:
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		reply = strconv.FormatUint(n, 10)
+		return &item{data: []byte(reply), flags: old.flags, ttl: old.ttl}
+	})
+	if err != nil {
+		c.serverError(err)
+		return
+	}
+	if reply[0] == 'C' {
+		c.w.WriteString(reply + "\r\n")
+		return
+	}
+	c.reply(reply)
+}
+
+// touch sets the expiry of a key: touch <key> <exptime> [noreply].
+func (c *conn) touch(args [][]byte) {
+	if len(args) < 3 || !validKey(args[1]) || !c.parseNoreply(args, 3) {
+		c.noreply = false
+		c.clientError(errBadLine.Error())
+		return
+	}
+	ttl, expired, err := parseExptime(args[2])
+	if err != nil {
+		c.noreply = false
+		c.clientError("invalid exptime argument")
+		return
+	}
+	reply := "NOT_FOUND"
+	err = c.update(args[1], func(old *item) *item {
+		if old == nil {
+			reply = "NOT_FOUND"
+			return nil
+		}
+		reply = "TOUCHED"
+		return &item{data: old.data, flags: old.flags, ttl: ttl, expired: expired}
+	})
+	if err != nil {
+		c.serverError(err)
+		return
+	}
+	c.reply(reply)
+}
+
+// update calls fn with the current item of key, nil if it doesn't exist, and
+// writes the item fn returns unless it is nil. An expired item deletes the
+// key. If the key changes before the write, fn is called again with the new
+// item.
+func (c *conn) update(key []byte, fn func(old *item) *item) error {
+	st := c.s.Storage
+	for {
+		data, flags, version, err := st.GetWithMeta(key)
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		var old *item
+		if err == nil {
+			ttl, err := st.TTL(key)
+			if err == storage.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			old = &item{data: data, flags: flags, ttl: ttl, version: version}
+		}
+		it := fn(old)
+		if it == nil {
+			return nil
+		}
+		switch {
+		case it.expired && old == nil:
+			return nil
+		case it.expired:
+			err = st.DeleteIfVersion(key, version)
+		case old == nil:
+			_, err = st.PutIfAbsent(key, it.data, it.flags, it.ttl)
+		default:
+			_, err = st.CompareAndSwapVersion(key, version, it.data, it.flags, it.ttl)
+		}
+		switch err {
+		case storage.ErrVersionMismatch, storage.ErrNotFound, storage.ErrKeyExists:
+			continue
+		}
+		return err
+	}
+}
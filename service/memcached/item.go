@@ -0,0 +1,53 @@
+package memcached
+
+import (
+	"strconv"
+	"time"
+)
+
+// the longest key of the protocol
+const maxKeyLen = 250
+
+// exptimes up to 30 days are relative, later ones are unix times
+const maxRelativeExptime = 30 * 24 * 60 * 60
+
+// item is a value with the metadata of the protocol. The flags are the meta
+// of the stored value, so the other protocols read and write the data as is.
+type item struct {
+	data    []byte
+	flags   uint32
+	ttl     time.Duration // 0 never expires
+	expired bool          // stored with an exptime in the past, deletes the key
+	version uint64        // the cas token
+}
+
+// parseExptime returns the ttl of an exptime, and whether it is already past.
+func parseExptime(s []byte) (time.Duration, bool, error) {
+	n, err := strconv.ParseInt(string(s), 10, 64)
+	switch {
+	case err != nil:
+		return 0, false, err
+	case n == 0:
+		return 0, false, nil
+	case n < 0:
+		return 0, true, nil
+	case n <= maxRelativeExptime:
+		return time.Duration(n) * time.Second, false, nil
+	}
+	ttl := time.Until(time.Unix(n, 0))
+	return ttl, ttl <= 0, nil
+}
+
+// validKey reports whether key is a key of the protocol, at most 250 bytes
+// without control characters.
+func validKey(key []byte) bool {
+	if len(key) == 0 || len(key) > maxKeyLen {
+		return false
+	}
+	for _, b := range key {
+		if b <= ' ' || b == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+// Package memcached serves the storage over the memcached text protocol, so
+// memcached clients can use mousedb as a persistent cache.
+package memcached
+
+import (
+	"net"
+
+	"mousedb/pkg/server"
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+// Service accepts the memcached connections of Listener and runs their
+// commands on Storage.
+type Service struct {
+	Listener net.Listener
+	Storage  *storage.Storage
+	Version  string // reported by the version command
+
+	Logger *zap.Logger
+
+	addr   string
+	server *server.Server
+}
+
+// NewService returns a new Service serving s on the bind address of c.
+func NewService(c Config, s *storage.Storage) *Service {
+	return &Service{
+		Storage: s,
+		Logger:  zap.NewNop(),
+		addr:    c.BindAddress,
+	}
+}
+
+// WithLogger sets the logger for the service.
+func (s *Service) WithLogger(log *zap.Logger) {
+	s.Logger = log.With(zap.String("service", "memcached"))
+}
+
+// Open listens on the bind address, unless Listener is already set, and
+// starts accepting connections.
+func (s *Service) Open() error {
+	if s.Listener == nil {
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.Listener = ln
+	}
+	s.server = server.Serve(s.Listener, s.Logger, func(nc net.Conn) {
+		newConn(s, nc).serve()
+	})
+	s.Logger.Info("listening for memcached connections", zap.String("addr", s.Listener.Addr().String()))
+	return nil
+}
+
+// Close stops accepting connections, and closes the open ones once their
+// current command is done.
+func (s *Service) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// Addr returns the address the service listens on, nil before Open.
+func (s *Service) Addr() net.Addr {
+	if s.Listener == nil {
+		return nil
+	}
+	return s.Listener.Addr()
+}
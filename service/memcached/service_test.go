@@ -0,0 +1,127 @@
+package memcached
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"mousedb/pkg/assert"
+	"mousedb/service/storage"
+)
+
+func openTestService(t *testing.T) (*storage.Storage, net.Conn) {
+	c := storage.NewConfig()
+	c.Dir = t.TempDir()
+	c.MergeSecs = 0
+	c.ValueMaxSize = 64
+	st := storage.New(c)
+	assert.Nil(t, st.Open())
+	mc := NewConfig()
+	mc.BindAddress = "127.0.0.1:0"
+	s := NewService(mc, st)
+	s.Version = "test"
+	assert.Nil(t, s.Open())
+	nc, err := net.Dial("tcp", s.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		nc.Close()
+		assert.Nil(t, s.Close())
+		assert.Nil(t, st.Close())
+	})
+	return st, nc
+}
+
+// roundTrip sends a request and reads lines of the reply until one of them
+// is a final line, the lines are joined with "|".
+func roundTrip(t *testing.T, nc net.Conn, r *bufio.Reader, req string) string {
+	_, err := nc.Write([]byte(req))
+	assert.Nil(t, err)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		assert.Nil(t, err)
+		line = strings.TrimSuffix(line, "\r\n")
+		lines = append(lines, line)
+		if !strings.HasPrefix(line, "VALUE ") && (len(lines) < 2 || !strings.HasPrefix(lines[len(lines)-2], "VALUE ")) {
+			return strings.Join(lines, "|")
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	st, nc := openTestService(t)
+	r := bufio.NewReader(nc)
+	for _, tc := range []struct {
+		req, reply string
+	}{
+		{"get foo\r\n", "END"},
+		{"set foo 0 0 3\r\nbar\r\n", "STORED"},
+		{"get foo\r\n", "VALUE foo 0 3|bar|END"},
+		{"set flagged 42 0 2\r\nhi\r\n", "STORED"},
+		{"get foo flagged nope\r\n", "VALUE foo 0 3|bar|VALUE flagged 42 2|hi|END"},
+		{"add foo 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"add new 0 0 1\r\nx\r\n", "STORED"},
+		{"replace nope 0 0 1\r\nx\r\n", "NOT_STORED"},
+		{"replace new 7 0 1\r\ny\r\n", "STORED"},
+		{"get new\r\n", "VALUE new 7 1|y|END"},
+		{"cas nope 0 0 1 1\r\nx\r\n", "NOT_FOUND"},
+		{"cas foo 0 0 1 1\r\nx\r\n", "EXISTS"},
+		{"set n 5 0 2\r\n10\r\n", "STORED"},
+		{"incr n 5\r\n", "15"},
+		{"decr n 100\r\n", "0"},
+		{"get n\r\n", "VALUE n 5 1|0|END"},
+		{"incr foo 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr nope 1\r\n", "NOT_FOUND"},
+		{"touch foo 100\r\n", "TOUCHED"},
+		{"touch nope 100\r\n", "NOT_FOUND"},
+		{"delete foo\r\n", "DELETED"},
+		{"delete foo\r\n", "NOT_FOUND"},
+		{"set foo 0 0 1 noreply\r\nx\r\ndelete nope noreply\r\nget foo\r\n", "VALUE foo 0 1|x|END"},
+		{"set foo 0 -1 1\r\nx\r\n", "STORED"},
+		{"get foo\r\n", "END"},
+		{"set big 0 0 65\r\n" + strings.Repeat("x", 65) + "\r\n", "SERVER_ERROR object too large for cache"},
+		{"set foo 0 0 1\r\nxyz\r\n", "CLIENT_ERROR bad data chunk"},
+		{"set foo bar 0 1\r\n", "CLIENT_ERROR bad command line format"},
+		{"flush_all\r\n", "ERROR"},
+		{"version\r\n", "VERSION test"},
+	} {
+		assert.Equal(t, tc.reply, roundTrip(t, nc, r, tc.req))
+	}
+
+	// touch sets the ttl of a key written by the other protocols
+	assert.Nil(t, st.Put([]byte("touched"), []byte("v")))
+	assert.Equal(t, "TOUCHED", roundTrip(t, nc, r, "touch touched 100\r\n"))
+	ttl, err := st.TTL([]byte("touched"))
+	assert.Nil(t, err)
+	assert.T(t, ttl > 99*time.Second && ttl <= 100*time.Second)
+}
+
+func TestCas(t *testing.T) {
+	_, nc := openTestService(t)
+	r := bufio.NewReader(nc)
+	assert.Equal(t, "STORED", roundTrip(t, nc, r, "set foo 3 0 3\r\nbar\r\n"))
+	reply := roundTrip(t, nc, r, "gets foo\r\n")
+	fields := strings.Fields(strings.Split(reply, "|")[0])
+	assert.Equal(t, 5, len(fields))
+	cas := fields[4]
+	assert.Equal(t, "STORED", roundTrip(t, nc, r, "cas foo 3 0 3 "+cas+"\r\nbaz\r\n"))
+	assert.Equal(t, "EXISTS", roundTrip(t, nc, r, "cas foo 3 0 3 "+cas+"\r\nqux\r\n"))
+	assert.Equal(t, "VALUE foo 3 3|baz|END", roundTrip(t, nc, r, "get foo\r\n"))
+}
+
+func TestSharedValues(t *testing.T) {
+	st, nc := openTestService(t)
+	r := bufio.NewReader(nc)
+
+	// the flags aren't part of the value the other protocols read
+	assert.Equal(t, "STORED", roundTrip(t, nc, r, "set flagged 3735928559 0 4\r\ndata\r\n"))
+	value, err := st.Get([]byte("flagged"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(value))
+
+	// nor is a value of the other protocols read as flags
+	assert.Nil(t, st.Put([]byte("raw"), []byte("\x00mcf\x00\x00\x00\x07data")))
+	assert.Equal(t, "VALUE raw 0 12|\x00mcf\x00\x00\x00\x07data|END", roundTrip(t, nc, r, "get raw\r\n"))
+}
@@ -0,0 +1,781 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mousedb/service/storage"
+)
+
+// command is a command of the protocol. A positive arity is the exact number
+// of arguments including the name, a negative one the least number.
+type command struct {
+	fn    func(c *conn, args [][]byte)
+	arity int
+}
+
+// commands by lower case name.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"ping":    {cmdPing, -1},
+		"echo":    {cmdEcho, 2},
+		"quit":    {cmdQuit, -1},
+		"select":  {cmdSelect, 2},
+		"hello":   {cmdHello, -1},
+		"client":  {cmdClient, -2},
+		"command": {cmdCommand, -1},
+		"config":  {cmdConfig, -2},
+		"info":    {cmdInfo, -1},
+		"dbsize":  {cmdDBSize, 1},
+		"time":    {cmdTime, 1},
+
+		"get":       {cmdGet, 2},
+		"set":       {cmdSet, -3},
+		"setnx":     {cmdSetNX, 3},
+		"setex":     {cmdSetEX, 4},
+		"psetex":    {cmdSetEX, 4},
+		"getset":    {cmdGetSet, 3},
+		"getdel":    {cmdGetDel, 2},
+		"mget":      {cmdMGet, -2},
+		"mset":      {cmdMSet, -3},
+		"del":       {cmdDel, -2},
+		"unlink":    {cmdDel, -2},
+		"exists":    {cmdExists, -2},
+		"type":      {cmdType, 2},
+		"strlen":    {cmdStrlen, 2},
+		"append":    {cmdAppend, 3},
+		"incr":      {cmdIncr, 2},
+		"decr":      {cmdIncr, 2},
+		"incrby":    {cmdIncr, 3},
+		"decrby":    {cmdIncr, 3},
+		"expire":    {cmdExpire, 3},
+		"pexpire":   {cmdExpire, 3},
+		"persist":   {cmdPersist, 2},
+		"ttl":       {cmdTTL, 2},
+		"pttl":      {cmdTTL, 2},
+		"keys":      {cmdKeys, 2},
+		"scan":      {cmdScan, -2},
+		"randomkey": {cmdRandomKey, 1},
+	}
+}
+
+const (
+	errSyntax     = "ERR syntax error"
+	errNotInteger = "ERR value is not an integer or out of range"
+)
+
+func cmdPing(c *conn, args [][]byte) {
+	switch len(args) {
+	case 1:
+		c.w.simple("PONG")
+	case 2:
+		c.w.bulk(args[1])
+	default:
+		c.reject("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func cmdEcho(c *conn, args [][]byte) {
+	c.w.bulk(args[1])
+}
+
+func cmdQuit(c *conn, args [][]byte) {
+	c.w.simple("OK")
+	c.quit = true
+}
+
+func cmdSelect(c *conn, args [][]byte) {
+	if string(args[1]) != "0" {
+		c.reject("ERR DB index is out of range")
+		return
+	}
+	c.w.simple("OK")
+}
+
+// cmdHello switches the protocol version: HELLO [protover [AUTH user pass] [SETNAME name]].
+func cmdHello(c *conn, args [][]byte) {
+	proto := c.w.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1]))
+		if err != nil || (v != 2 && v != 3) {
+			c.reject("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	name := c.name
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "AUTH":
+			c.reject("ERR AUTH is not supported, no password is set")
+			return
+		case "SETNAME":
+			if i+1 >= len(args) {
+				c.reject(errSyntax)
+				return
+			}
+			name = string(args[i+1])
+			i++
+		default:
+			c.reject(errSyntax)
+			return
+		}
+	}
+	c.w.proto, c.name = proto, name
+
+	c.w.mapHeader(7)
+	c.w.bulkString("server")
+	c.w.bulkString("mousedb")
+	c.w.bulkString("version")
+	c.w.bulkString(c.s.Version)
+	c.w.bulkString("proto")
+	c.w.int(int64(proto))
+	c.w.bulkString("id")
+	c.w.int(int64(c.id))
+	c.w.bulkString("mode")
+	c.w.bulkString("standalone")
+	c.w.bulkString("role")
+	c.w.bulkString("master")
+	c.w.bulkString("modules")
+	c.w.array(0)
+}
+
+func cmdClient(c *conn, args [][]byte) {
+	switch strings.ToUpper(string(args[1])) {
+	case "SETNAME":
+		if len(args) != 3 {
+			c.reject("ERR wrong number of arguments for 'client|setname' command")
+			return
+		}
+		c.name = string(args[2])
+		c.w.simple("OK")
+	case "GETNAME":
+		if c.name == "" {
+			c.w.null()
+			return
+		}
+		c.w.bulkString(c.name)
+	case "ID":
+		c.w.int(int64(c.id))
+	case "SETINFO":
+		c.w.simple("OK")
+	default:
+		c.reject(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+	}
+}
+
+// cmdCommand tells the clients asking for the command table that it is empty.
+func cmdCommand(c *conn, args [][]byte) {
+	if len(args) > 1 && strings.ToUpper(string(args[1])) == "COUNT" {
+		c.w.int(int64(len(commands)))
+		return
+	}
+	c.w.array(0)
+}
+
+// configParams are the parameters CONFIG GET tells about, asked by redis-benchmark.
+var configParams = map[string]string{
+	"save":       "",
+	"appendonly": "no",
+	"databases":  "1",
+}
+
+func cmdConfig(c *conn, args [][]byte) {
+	if strings.ToUpper(string(args[1])) != "GET" {
+		c.reject(fmt.Sprintf("ERR unknown subcommand '%s'", args[1]))
+		return
+	}
+	var names []string
+	for name := range configParams {
+		for _, pattern := range args[2:] {
+			if globMatch(strings.ToLower(string(pattern)), name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	c.w.mapHeader(len(names))
+	for _, name := range names {
+		c.w.bulkString(name)
+		c.w.bulkString(configParams[name])
+	}
+}
+
+func cmdInfo(c *conn, args [][]byte) {
+	sections := map[string]bool{}
+	for _, arg := range args[1:] {
+		sections[strings.ToLower(string(arg))] = true
+	}
+	all := len(sections) == 0 || sections["all"] || sections["default"] || sections["everything"]
+	st := c.s.Storage.Stats()
+
+	var b strings.Builder
+	section := func(name string, fields ...interface{}) {
+		if !all && !sections[strings.ToLower(name)] {
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s\r\n", name)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&b, "%s:%v\r\n", fields[i], fields[i+1])
+		}
+	}
+	uptime := time.Since(c.s.started)
+	section("Server",
+		"mousedb_version", c.s.Version,
+		"process_id", os.Getpid(),
+		"tcp_addr", c.s.Listener.Addr().String(),
+		"uptime_in_seconds", int64(uptime.Seconds()),
+		"uptime_in_days", int64(uptime.Hours()/24))
+	section("Clients",
+		"connected_clients", c.s.clients())
+	section("Stats",
+		"total_connections_received", atomic.LoadUint64(&c.s.stats.connections),
+		"total_commands_processed", atomic.LoadUint64(&c.s.stats.commands),
+		"total_error_replies", atomic.LoadUint64(&c.s.stats.rejected))
+	section("Storage",
+		"keydir_keys", st.KeydirKeys,
+		"keydir_key_bytes", st.KeydirKeyBytes,
+		"keydir_arena_bytes", st.KeydirArenaBytes,
+		"keydir_node_bytes", st.KeydirNodeBytes,
+		"checksum_failures", st.ChecksumFailures,
+		"syncs", st.Syncs,
+		"write_groups", st.WriteGroups)
+	section("Keyspace",
+		"db0", fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", st.KeydirKeys))
+	c.w.verbatim(b.String())
+}
+
+// cmdDBSize replies the number of keys in the keydir, which is approximate
+// like the one of redis: it counts the keys which expired until a merge or a
+// read drops them.
+func cmdDBSize(c *conn, args [][]byte) {
+	c.w.int(int64(c.s.Storage.Stats().KeydirKeys))
+}
+
+func cmdTime(c *conn, args [][]byte) {
+	now := time.Now()
+	c.w.array(2)
+	c.w.bulkString(strconv.FormatInt(now.Unix(), 10))
+	c.w.bulkString(strconv.FormatInt(int64(now.Nanosecond()/1000), 10))
+}
+
+func cmdGet(c *conn, args [][]byte) {
+	value, err := c.s.Storage.Get(args[1])
+	switch err {
+	case nil:
+		c.w.bulk(value)
+	case storage.ErrNotFound:
+		c.w.null()
+	default:
+		c.storageError(err)
+	}
+}
+
+// cmdSet sets a key: SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|KEEPTTL].
+// The expiry is kept in seconds, PX is rounded up.
+func cmdSet(c *conn, args [][]byte) {
+	key, value := args[1], args[2]
+	var nx, xx, get, keepTTL, hasTTL bool
+	ttl := c.defaultTTL()
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if hasTTL || i+1 >= len(args) {
+				c.reject(errSyntax)
+				return
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil {
+				c.reject(errNotInteger)
+				return
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			if n <= 0 || n > math.MaxInt64/int64(unit) {
+				c.reject("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl, hasTTL = time.Duration(n)*unit, true
+			i++
+		default:
+			c.reject(errSyntax)
+			return
+		}
+	}
+	if (nx && xx) || (keepTTL && hasTTL) {
+		c.reject(errSyntax)
+		return
+	}
+
+	if !nx && !xx && !get && !keepTTL {
+		if err := c.s.Storage.PutWithTTL(key, value, ttl); err != nil {
+			c.storageError(err)
+			return
+		}
+		c.w.simple("OK")
+		return
+	}
+	var old []byte
+	var existed, written bool
+	err := c.update(key, func(cur []byte, curTTL time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		old, existed = cur, exists
+		if (nx && exists) || (xx && !exists) {
+			return nil, 0, false, nil
+		}
+		written = true
+		if keepTTL && exists {
+			return value, curTTL, true, nil
+		}
+		return value, ttl, true, nil
+	})
+	switch {
+	case err != nil:
+		c.storageError(err)
+	case get && existed:
+		c.w.bulk(old)
+	case get || !written:
+		c.w.null()
+	default:
+		c.w.simple("OK")
+	}
+}
+
+func cmdSetNX(c *conn, args [][]byte) {
+	_, err := c.s.Storage.PutIfAbsent(args[1], args[2], 0, c.defaultTTL())
+	switch err {
+	case nil:
+		c.w.int(1)
+	case storage.ErrKeyExists:
+		c.w.int(0)
+	default:
+		c.storageError(err)
+	}
+}
+
+// cmdSetEX sets a key with a ttl: SETEX key seconds value, or PSETEX key milliseconds value.
+func cmdSetEX(c *conn, args [][]byte) {
+	name := strings.ToLower(string(args[0]))
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.reject(errNotInteger)
+		return
+	}
+	unit := time.Second
+	if name == "psetex" {
+		unit = time.Millisecond
+	}
+	if n <= 0 || n > math.MaxInt64/int64(unit) {
+		c.reject(fmt.Sprintf("ERR invalid expire time in '%s' command", name))
+		return
+	}
+	if err := c.s.Storage.PutWithTTL(args[1], args[3], time.Duration(n)*unit); err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+func cmdGetSet(c *conn, args [][]byte) {
+	var old []byte
+	var existed bool
+	err := c.update(args[1], func(cur []byte, _ time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		old, existed = cur, exists
+		return args[2], c.defaultTTL(), true, nil
+	})
+	switch {
+	case err != nil:
+		c.storageError(err)
+	case existed:
+		c.w.bulk(old)
+	default:
+		c.w.null()
+	}
+}
+
+func cmdGetDel(c *conn, args [][]byte) {
+	st := c.s.Storage
+	for {
+		value, version, err := st.GetWithVersion(args[1])
+		if err == storage.ErrNotFound {
+			c.w.null()
+			return
+		}
+		if err != nil {
+			c.storageError(err)
+			return
+		}
+		err = st.DeleteIfVersion(args[1], version)
+		if err == storage.ErrVersionMismatch || err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			c.storageError(err)
+			return
+		}
+		c.w.bulk(value)
+		return
+	}
+}
+
+func cmdMGet(c *conn, args [][]byte) {
+	values := make([][]byte, len(args)-1)
+	for i, key := range args[1:] {
+		value, err := c.s.Storage.Get(key)
+		if err != nil && err != storage.ErrNotFound {
+			c.storageError(err)
+			return
+		}
+		values[i] = value
+	}
+	c.w.array(len(values))
+	for _, value := range values {
+		if value == nil {
+			c.w.null()
+			continue
+		}
+		c.w.bulk(value)
+	}
+}
+
+// cmdMSet sets all the keys at once in a batch.
+func cmdMSet(c *conn, args [][]byte) {
+	if len(args)%2 != 1 {
+		c.reject("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	b := storage.NewBatch()
+	for i := 1; i < len(args); i += 2 {
+		b.Put(args[i], args[i+1])
+	}
+	if err := c.s.Storage.Write(b); err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.simple("OK")
+}
+
+// cmdDel deletes the keys at once in a batch, and replies how many existed.
+// cmdDel deletes the keys one by one, and counts the deletes which found their key.
+func cmdDel(c *conn, args [][]byte) {
+	n := 0
+	for _, key := range args[1:] {
+		switch err := c.s.Storage.Del(key); err {
+		case nil:
+			n++
+		case storage.ErrNotFound:
+		default:
+			c.storageError(err)
+			return
+		}
+	}
+	c.w.int(int64(n))
+}
+
+func cmdExists(c *conn, args [][]byte) {
+	n := 0
+	for _, key := range args[1:] {
+		if c.exists(key) {
+			n++
+		}
+	}
+	c.w.int(int64(n))
+}
+
+func (c *conn) exists(key []byte) bool {
+	_, err := c.s.Storage.TTL(key)
+	return err == nil
+}
+
+func cmdType(c *conn, args [][]byte) {
+	if c.exists(args[1]) {
+		c.w.simple("string")
+		return
+	}
+	c.w.simple("none")
+}
+
+func cmdStrlen(c *conn, args [][]byte) {
+	value, err := c.s.Storage.Get(args[1])
+	if err != nil && err != storage.ErrNotFound {
+		c.storageError(err)
+		return
+	}
+	c.w.int(int64(len(value)))
+}
+
+func cmdAppend(c *conn, args [][]byte) {
+	var n int
+	err := c.update(args[1], func(cur []byte, ttl time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		value := append(append(make([]byte, 0, len(cur)+len(args[2])), cur...), args[2]...)
+		n = len(value)
+		if !exists {
+			ttl = c.defaultTTL()
+		}
+		return value, ttl, true, nil
+	})
+	if err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.int(int64(n))
+}
+
+// errNotIntegerValue is returned when the value of a key isn't an integer.
+var errNotIntegerValue = errors.New("value is not an integer or out of range")
+
+// cmdIncr adds to the integer value of a key: INCR, DECR, INCRBY and DECRBY.
+func cmdIncr(c *conn, args [][]byte) {
+	delta := int64(1)
+	if len(args) == 3 {
+		var err error
+		if delta, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			c.reject(errNotInteger)
+			return
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(string(args[0])), "decr") {
+		if delta == math.MinInt64 {
+			c.reject("ERR decrement would overflow")
+			return
+		}
+		delta = -delta
+	}
+	var n int64
+	err := c.update(args[1], func(cur []byte, ttl time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		n = 0
+		if exists {
+			var err error
+			if n, err = strconv.ParseInt(string(cur), 10, 64); err != nil {
+				return nil, 0, false, errNotIntegerValue
+			}
+		} else {
+			ttl = c.defaultTTL()
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, 0, false, errors.New("increment or decrement would overflow")
+		}
+		n += delta
+		return strconv.AppendInt(nil, n, 10), ttl, true, nil
+	})
+	if err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.int(n)
+}
+
+// cmdExpire sets the ttl of a key: EXPIRE key seconds, or PEXPIRE key
+// milliseconds. A ttl <= 0 deletes the key.
+func cmdExpire(c *conn, args [][]byte) {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		c.reject(errNotInteger)
+		return
+	}
+	unit := time.Second
+	if strings.ToLower(string(args[0])) == "pexpire" {
+		unit = time.Millisecond
+	}
+	if n > math.MaxInt64/int64(unit) {
+		c.reject(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(string(args[0]))))
+		return
+	}
+	if n <= 0 {
+		cmdDel(c, args[:2])
+		return
+	}
+	existed := false
+	err = c.update(args[1], func(cur []byte, _ time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		existed = exists
+		return cur, time.Duration(n) * unit, exists, nil
+	})
+	if err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.int(boolInt(existed))
+}
+
+func cmdPersist(c *conn, args [][]byte) {
+	persisted := false
+	err := c.update(args[1], func(cur []byte, ttl time.Duration, exists bool) ([]byte, time.Duration, bool, error) {
+		persisted = exists && ttl > 0
+		return cur, 0, persisted, nil
+	})
+	if err != nil {
+		c.storageError(err)
+		return
+	}
+	c.w.int(boolInt(persisted))
+}
+
+// cmdTTL replies the ttl of a key, -2 if it doesn't exist and -1 if it never
+// expires. The expiry is kept in whole seconds, so TTL rounds up.
+func cmdTTL(c *conn, args [][]byte) {
+	ttl, err := c.s.Storage.TTL(args[1])
+	switch {
+	case err == storage.ErrNotFound:
+		c.w.int(-2)
+	case err != nil:
+		c.storageError(err)
+	case ttl == 0:
+		c.w.int(-1)
+	case strings.ToLower(string(args[0])) == "pttl":
+		c.w.int(ttl.Milliseconds())
+	default:
+		c.w.int(int64((ttl + time.Second - 1) / time.Second))
+	}
+}
+
+func cmdKeys(c *conn, args [][]byte) {
+	pattern := string(args[1])
+	it := c.s.Storage.NewIterator(&storage.IteratorOptions{Prefix: []byte(globPrefix(pattern))})
+	defer it.Close()
+	var keys [][]byte
+	for ok := it.First(); ok; ok = it.Next() {
+		if key := it.Key(); globMatch(pattern, string(key)) {
+			keys = append(keys, key)
+		}
+	}
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
+
+// cmdScan pages through the keys in key order: SCAN cursor [MATCH pattern]
+// [COUNT count] [TYPE type]. The cursors are shared by the connections, an
+// unknown or too old cursor is an error rather than the end of the scan.
+func cmdScan(c *conn, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		c.reject("ERR invalid cursor")
+		return
+	}
+	pattern, count, typ := "*", 10, "string"
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.reject(errSyntax)
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count < 1 {
+				c.reject(errSyntax)
+				return
+			}
+		case "TYPE":
+			typ = strings.ToLower(string(args[i+1]))
+		default:
+			c.reject(errSyntax)
+			return
+		}
+	}
+
+	it := c.s.Storage.NewIterator(&storage.IteratorOptions{Prefix: []byte(globPrefix(pattern))})
+	defer it.Close()
+	ok := false
+	if cursor == 0 {
+		ok = it.First()
+	} else if start, found := c.s.cursors.get(cursor); found {
+		ok = it.Seek([]byte(start))
+	} else {
+		c.reject("ERR invalid cursor")
+		return
+	}
+	var keys [][]byte
+	for ; ok && count > 0; ok, count = it.Next(), count-1 {
+		if key := it.Key(); typ == "string" && globMatch(pattern, string(key)) {
+			keys = append(keys, key)
+		}
+	}
+
+	next := uint64(0)
+	if ok {
+		next = c.s.cursors.add(string(it.Key()))
+	}
+	c.w.array(2)
+	c.w.bulkString(strconv.FormatUint(next, 10))
+	c.w.array(len(keys))
+	for _, key := range keys {
+		c.w.bulk(key)
+	}
+}
+
+// cmdRandomKey replies the first key from a random key between the first and
+// the last one. The keydir is ordered without positions, so the keys after a
+// wide gap are picked more often.
+func cmdRandomKey(c *conn, args [][]byte) {
+	it := c.s.Storage.NewIterator(nil)
+	defer it.Close()
+	if !it.Last() {
+		c.w.null()
+		return
+	}
+	last := it.Key()
+	if !it.First() {
+		c.w.null()
+		return
+	}
+	if !it.Seek(randomKeyBetween(it.Key(), last)) && !it.Last() {
+		c.w.null()
+		return
+	}
+	c.w.bulk(it.Key())
+}
+
+// randomKeyBetween returns a random key about between lo and hi, lo <= hi.
+// It shares the common prefix of lo and hi, the next byte is within theirs.
+func randomKeyBetween(lo, hi []byte) []byte {
+	i := 0
+	for i < len(lo) && i < len(hi) && lo[i] == hi[i] {
+		i++
+	}
+	if i == len(hi) {
+		return hi
+	}
+	var b byte
+	if i < len(lo) {
+		b = lo[i]
+	}
+	key := make([]byte, i+1, i+9)
+	copy(key, hi[:i])
+	key[i] = b + byte(rand.Intn(int(hi[i]-b)+1))
+	for j := 0; j < 8; j++ {
+		key = append(key, byte(rand.Intn(256)))
+	}
+	return key
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package resp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// the largest argument when storage.Config.ValueMaxSize is 0
+	defaultMaxBulk = 1 << 20
+	// the room left above the largest value for the other arguments
+	bulkMargin = 16 << 10
+)
+
+// conn is a client connection.
+type conn struct {
+	s  *Service
+	nc net.Conn
+	r  *reader
+	w  *writer
+
+	id   uint64
+	name string
+
+	quit bool
+}
+
+func newConn(s *Service, nc net.Conn) *conn {
+	return &conn{
+		s:  s,
+		nc: nc,
+		r:  newReader(nc, maxBulk(s.Storage)),
+		w:  newWriter(nc),
+		id: atomic.AddUint64(&s.clientID, 1),
+	}
+}
+
+// maxBulk returns the largest argument of a command, a value can't be larger
+// than storage.Config.ValueMaxSize anyway.
+func maxBulk(st *storage.Storage) int {
+	limit := int(st.Config.ValueMaxSize)
+	if limit <= 0 {
+		limit = defaultMaxBulk
+	}
+	return limit + bulkMargin
+}
+
+// serve runs the commands of the client until it quits or breaks the
+// protocol. The replies are flushed when no more command is buffered, so a
+// pipeline is answered with a single write.
+func (c *conn) serve() {
+	defer c.nc.Close()
+	for !c.quit {
+		args, err := c.r.readCommand()
+		if err != nil {
+			if errors.Is(err, errProtocol) {
+				c.w.error("ERR " + err.Error())
+				c.w.flush()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				c.s.Logger.Debug("read a command failed", zap.String("addr", c.nc.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.run(args)
+		if !c.r.buffered() {
+			if err := c.w.flush(); err != nil {
+				return
+			}
+		}
+	}
+	c.w.flush()
+}
+
+// run runs a command and writes its reply.
+func (c *conn) run(args [][]byte) {
+	atomic.AddUint64(&c.s.stats.commands, 1)
+	name := strings.ToLower(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		c.reject(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], quoteArgs(args[1:])))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.reject(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	cmd.fn(c, args)
+}
+
+// reject replies an error.
+func (c *conn) reject(msg string) {
+	atomic.AddUint64(&c.s.stats.rejected, 1)
+	c.w.error(msg)
+}
+
+// storageError replies an error returned by the storage.
+func (c *conn) storageError(err error) {
+	switch {
+	case errors.Is(err, storage.ErrReadOnly):
+		c.reject("READONLY You can't write against a read only storage.")
+	case errors.Is(err, storage.ErrClosed):
+		c.reject("ERR storage is closed")
+	default:
+		c.reject("ERR " + err.Error())
+	}
+}
+
+// defaultTTL is the ttl of the keys set without one, see storage.Config.ExpirySecs.
+func (c *conn) defaultTTL() time.Duration {
+	return time.Duration(c.s.Storage.Config.ExpirySecs) * time.Second
+}
+
+// update calls fn with the current value of key and its ttl, and writes the
+// value and ttl fn returns unless write is false, the meta of the value stays.
+// If the key changes before the write, fn is called again with the new value.
+func (c *conn) update(key []byte, fn func(old []byte, ttl time.Duration, exists bool) (value []byte, newTTL time.Duration, write bool, err error)) error {
+	st := c.s.Storage
+	for {
+		old, meta, version, err := st.GetWithMeta(key)
+		exists := err == nil
+		if err != nil && err != storage.ErrNotFound {
+			return err
+		}
+		var ttl time.Duration
+		if exists {
+			if ttl, err = st.TTL(key); err == storage.ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+		}
+		value, newTTL, write, err := fn(old, ttl, exists)
+		if err != nil || !write {
+			return err
+		}
+		if exists {
+			_, err = st.CompareAndSwapVersion(key, version, value, meta, newTTL)
+		} else {
+			_, err = st.PutIfAbsent(key, value, 0, newTTL)
+		}
+		switch err {
+		case storage.ErrVersionMismatch, storage.ErrNotFound, storage.ErrKeyExists:
+			continue
+		}
+		return err
+	}
+}
+
+// quoteArgs formats the first arguments of an unknown command like redis does.
+func quoteArgs(args [][]byte) string {
+	var b strings.Builder
+	for i, arg := range args {
+		if i == 10 {
+			break
+		}
+		fmt.Fprintf(&b, "'%s' ", arg)
+	}
+	return b.String()
+}
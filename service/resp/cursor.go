@@ -0,0 +1,41 @@
+package resp
+
+import "sync"
+
+// the most SCAN cursors kept, a newer cursor takes the place of the oldest
+const maxCursors = 4096
+
+// cursors holds the SCAN cursors of all the connections, so a scan started
+// on a connection goes on on another one, as pooled clients do. A cursor
+// holds the key its page starts at, it can be used again until a newer
+// cursor takes its place.
+type cursors struct {
+	mu    sync.Mutex
+	last  uint64 // the last cursor given
+	slots [maxCursors]struct {
+		cursor uint64
+		key    string
+	}
+}
+
+// add returns a new cursor starting at key.
+func (cs *cursors) add(key string) uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.last++
+	slot := &cs.slots[cs.last%maxCursors]
+	slot.cursor, slot.key = cs.last, key
+	return cs.last
+}
+
+// get returns the key cursor starts at, false if the cursor is unknown or
+// too old.
+func (cs *cursors) get(cursor uint64) (string, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	slot := &cs.slots[cursor%maxCursors]
+	if cursor == 0 || slot.cursor != cursor {
+		return "", false
+	}
+	return slot.key, true
+}
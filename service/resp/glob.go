@@ -0,0 +1,104 @@
+package resp
+
+// globMatch reports whether s matches the redis glob pattern: * matches any
+// bytes, ? any byte, [abc], [^abc] and [a-z] a byte of a set, and \ escapes
+// the next byte.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			rest, ok := matchClass(pattern[1:], s[0])
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches b against the class at the start of pattern, after its
+// '[', and returns the pattern following the class.
+func matchClass(pattern string, b byte) (string, bool) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		c := pattern[0]
+		if c == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			c = pattern[0]
+		}
+		if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			lo, hi := c, pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if lo <= b && b <= hi {
+				match = true
+			}
+			pattern = pattern[3:]
+			continue
+		}
+		if c == b {
+			match = true
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		// skip the ']'
+		pattern = pattern[1:]
+	}
+	return pattern, match != not
+}
+
+// globPrefix returns the literal prefix of pattern, the keys matching it
+// all start with it.
+func globPrefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return string(prefix)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix = append(prefix, pattern[i])
+	}
+	return string(prefix)
+}
@@ -0,0 +1,229 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	maxArgs     = 1 << 20  // the most arguments of a command
+	maxInlineLn = 64 << 10 // the longest inline command
+	bulkChunk   = 64 << 10 // a larger argument is read in chunks of this size
+)
+
+// zeroChunk is appended to an argument to make room for the next chunk.
+var zeroChunk [bulkChunk]byte
+
+// errProtocol is returned when a client breaks the protocol, the connection
+// is closed after the error is replied.
+var errProtocol = errors.New("Protocol error")
+
+// protocolError is an errProtocol with its reason.
+type protocolError string
+
+func (e protocolError) Error() string { return errProtocol.Error() + ": " + string(e) }
+func (e protocolError) Unwrap() error { return errProtocol }
+
+// reader reads the commands of a client, as arrays of bulk strings or as
+// inline commands split on spaces.
+type reader struct {
+	r       *bufio.Reader
+	maxBulk int // the largest argument of a command
+}
+
+func newReader(r io.Reader, maxBulk int) *reader {
+	return &reader{r: bufio.NewReaderSize(r, 16<<10), maxBulk: maxBulk}
+}
+
+// buffered returns whether more commands are already read, the replies are
+// flushed once a client is done pipelining.
+func (r *reader) buffered() bool {
+	return r.r.Buffered() > 0
+}
+
+// readCommand returns the arguments of the next command, it returns no
+// argument for an empty inline command.
+func (r *reader) readCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	// the array grows with the arguments read rather than the count announced
+	args := make([][]byte, 0, minInt(n, 64))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$'")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > r.maxBulk {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads a bulk string of size bytes and its CRLF. A large one is
+// read in chunks, so the memory follows the bytes the client sends rather
+// than the length it announces.
+func (r *reader) readBulk(size int) ([]byte, error) {
+	arg := make([]byte, 0, minInt(size+2, bulkChunk))
+	for len(arg) < size+2 {
+		start := len(arg)
+		arg = append(arg, zeroChunk[:minInt(size+2-start, bulkChunk)]...)
+		if _, err := io.ReadFull(r.r, arg[start:]); err != nil {
+			return nil, err
+		}
+	}
+	if arg[size] != '\r' || arg[size+1] != '\n' {
+		return nil, protocolError("bulk string not terminated by CRLF")
+	}
+	return arg[:size:size], nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readLine reads a line without its CRLF, a copy of the buffer.
+func (r *reader) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(line) > maxInlineLn {
+			return nil, protocolError("too big inline request")
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
+
+// writer writes the replies of the version of the protocol picked by the
+// client, RESP2 until it switches with HELLO.
+type writer struct {
+	w     *bufio.Writer
+	proto int
+	num   []byte
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{w: bufio.NewWriterSize(w, 16<<10), proto: 2}
+}
+
+func (w *writer) flush() error {
+	return w.w.Flush()
+}
+
+func (w *writer) line(prefix byte, s string) {
+	w.w.WriteByte(prefix)
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+func (w *writer) header(prefix byte, n int64) {
+	w.w.WriteByte(prefix)
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	w.w.Write(w.num)
+	w.w.WriteString("\r\n")
+}
+
+// simple writes a simple string.
+func (w *writer) simple(s string) {
+	w.line('+', s)
+}
+
+// error writes an error, msg starts with its code such as ERR.
+func (w *writer) error(msg string) {
+	w.line('-', msg)
+}
+
+// int writes an integer.
+func (w *writer) int(n int64) {
+	w.header(':', n)
+}
+
+// bulk writes a bulk string.
+func (w *writer) bulk(b []byte) {
+	w.header('$', int64(len(b)))
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+// bulkString writes a bulk string.
+func (w *writer) bulkString(s string) {
+	w.header('$', int64(len(s)))
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// null writes a null bulk string.
+func (w *writer) null() {
+	if w.proto == 3 {
+		w.w.WriteString("_\r\n")
+		return
+	}
+	w.w.WriteString("$-1\r\n")
+}
+
+// array writes the header of an array of n elements.
+func (w *writer) array(n int) {
+	w.header('*', int64(n))
+}
+
+// mapHeader writes the header of a map of n pairs, an array of 2n elements in RESP2.
+func (w *writer) mapHeader(n int) {
+	if w.proto == 3 {
+		w.header('%', int64(n))
+		return
+	}
+	w.array(2 * n)
+}
+
+// verbatim writes a text, a verbatim string in RESP3.
+func (w *writer) verbatim(s string) {
+	if w.proto == 3 {
+		w.header('=', int64(len(s)+4))
+		w.w.WriteString("txt:")
+		w.w.WriteString(s)
+		w.w.WriteString("\r\n")
+		return
+	}
+	w.bulkString(s)
+}
@@ -0,0 +1,81 @@
+// Package resp serves the storage over the Redis serialization protocol,
+// RESP2 and RESP3, so Redis clients and tools can talk to mousedb.
+package resp
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"mousedb/pkg/server"
+	"mousedb/service/storage"
+
+	"go.uber.org/zap"
+)
+
+// Service accepts the RESP connections of Listener and runs their commands
+// on Storage.
+type Service struct {
+	Listener net.Listener
+	Storage  *storage.Storage
+	Version  string // reported by HELLO and INFO
+
+	Logger *zap.Logger
+
+	server *server.Server
+
+	started  time.Time
+	clientID uint64
+	stats    stats
+	cursors  cursors
+}
+
+// stats are the counters reported by INFO, updated atomically.
+type stats struct {
+	connections uint64 // connections accepted
+	commands    uint64 // commands run
+	rejected    uint64 // commands refused with an error
+}
+
+// NewService returns a new Service serving s on ln.
+func NewService(ln net.Listener, s *storage.Storage) *Service {
+	return &Service{
+		Listener: ln,
+		Storage:  s,
+		Logger:   zap.NewNop(),
+	}
+}
+
+// WithLogger sets the logger for the service.
+func (s *Service) WithLogger(log *zap.Logger) {
+	s.Logger = log.With(zap.String("service", "resp"))
+}
+
+// Open starts accepting connections.
+func (s *Service) Open() error {
+	if s.Listener == nil {
+		return errors.New("resp: no listener")
+	}
+	s.started = time.Now()
+	s.server = server.Serve(s.Listener, s.Logger, func(nc net.Conn) {
+		atomic.AddUint64(&s.stats.connections, 1)
+		newConn(s, nc).serve()
+	})
+	s.Logger.Info("listening for RESP connections", zap.String("addr", s.Listener.Addr().String()))
+	return nil
+}
+
+// Close stops accepting connections, and closes the open ones once their
+// current command is done.
+func (s *Service) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// clients returns the number of open connections.
+func (s *Service) clients() int {
+	return s.server.Conns()
+}
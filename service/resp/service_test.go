@@ -0,0 +1,252 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"mousedb/pkg/assert"
+	"mousedb/service/storage"
+)
+
+func openTestService(t *testing.T) net.Conn {
+	c := storage.NewConfig()
+	c.Dir = t.TempDir()
+	c.MergeSecs = 0
+	st := storage.New(c)
+	assert.Nil(t, st.Open())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := NewService(ln, st)
+	s.Version = "test"
+	assert.Nil(t, s.Open())
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		nc.Close()
+		assert.Nil(t, s.Close())
+		assert.Nil(t, st.Close())
+	})
+	return nc
+}
+
+// send writes the commands as arrays of bulk strings in one write.
+func send(t *testing.T, nc net.Conn, cmds ...[]string) {
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	_, err := nc.Write([]byte(b.String()))
+	assert.Nil(t, err)
+}
+
+// readReply reads a reply and formats it on one line, arrays in brackets.
+func readReply(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	assert.Nil(t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		if n < 0 {
+			return "nil"
+		}
+		b := make([]byte, n+2)
+		_, err := io.ReadFull(r, b)
+		assert.Nil(t, err)
+		return string(b[:n])
+	case '*', '%':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		if line[0] == '%' {
+			n *= 2
+		}
+		elems := make([]string, n)
+		for i := range elems {
+			elems[i] = readReply(t, r)
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	case '_':
+		return "nil"
+	}
+	return line
+}
+
+func TestCommands(t *testing.T) {
+	nc := openTestService(t)
+	r := bufio.NewReader(nc)
+	for _, tc := range []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"get", "foo"}, "nil"},
+		{[]string{"SET", "foo", "bar"}, "+OK"},
+		{[]string{"GET", "foo"}, "bar"},
+		{[]string{"SET", "foo", "baz", "NX"}, "nil"},
+		{[]string{"SET", "foo", "baz", "XX", "GET"}, "bar"},
+		{[]string{"SETNX", "foo", "qux"}, ":0"},
+		{[]string{"MSET", "a", "1", "b", "2"}, "+OK"},
+		{[]string{"MGET", "a", "b", "c", "foo"}, "[1 2 nil baz]"},
+		{[]string{"EXISTS", "a", "c", "foo"}, ":2"},
+		{[]string{"INCR", "a"}, ":2"},
+		{[]string{"DECRBY", "b", "5"}, ":-3"},
+		{[]string{"INCR", "foo"}, "-ERR value is not an integer or out of range"},
+		{[]string{"APPEND", "foo", "!"}, ":4"},
+		{[]string{"STRLEN", "foo"}, ":4"},
+		{[]string{"TTL", "foo"}, ":-1"},
+		{[]string{"EXPIRE", "foo", "100"}, ":1"},
+		{[]string{"TTL", "foo"}, ":100"},
+		{[]string{"PERSIST", "foo"}, ":1"},
+		{[]string{"TTL", "c"}, ":-2"},
+		{[]string{"KEYS", "[ab]"}, "[a b]"},
+		{[]string{"SCAN", "0", "COUNT", "10"}, "[0 [a b foo]]"},
+		{[]string{"DEL", "a", "c", "foo"}, ":2"},
+		{[]string{"DBSIZE"}, ":1"},
+		{[]string{"GETDEL", "b"}, "-3"},
+		{[]string{"DBSIZE"}, ":0"},
+		{[]string{"SET", "foo", "bar", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"NOPE", "x"}, "-ERR unknown command 'NOPE', with args beginning with: 'x' "},
+		{[]string{"HELLO", "3"}, "[server mousedb version test proto :3 id :1 mode standalone role master modules []]"},
+		{[]string{"GET", "foo"}, "nil"},
+	} {
+		send(t, nc, tc.args)
+		assert.Equal(t, tc.reply, readReply(t, r))
+	}
+}
+
+func TestPipelineAndScan(t *testing.T) {
+	nc := openTestService(t)
+	r := bufio.NewReader(nc)
+
+	var cmds [][]string
+	for i := 0; i < 100; i++ {
+		cmds = append(cmds, []string{"SET", fmt.Sprintf("key:%03d", i), fmt.Sprint(i)})
+	}
+	send(t, nc, cmds...)
+	for range cmds {
+		assert.Equal(t, "+OK", readReply(t, r))
+	}
+
+	// inline commands
+	_, err := nc.Write([]byte("PING hello\r\nDBSIZE\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", readReply(t, r))
+	assert.Equal(t, ":100", readReply(t, r))
+
+	keys, cursor := 0, "0"
+	for {
+		send(t, nc, []string{"SCAN", cursor, "MATCH", "key:0[0-4]*", "COUNT", "7"})
+		reply := readReply(t, r)
+		reply = strings.TrimSuffix(strings.TrimPrefix(reply, "["), "]")
+		i := strings.IndexByte(reply, ' ')
+		cursor = reply[:i]
+		keys += len(strings.Fields(strings.Trim(reply[i+1:], "[]")))
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 50, keys)
+}
+
+func TestScanAcrossConnections(t *testing.T) {
+	nc1 := openTestService(t)
+	nc2, err := net.Dial("tcp", nc1.RemoteAddr().String())
+	assert.Nil(t, err)
+	defer nc2.Close()
+	ncs := []net.Conn{nc1, nc2}
+	rs := []*bufio.Reader{bufio.NewReader(nc1), bufio.NewReader(nc2)}
+
+	for i := 0; i < 30; i++ {
+		send(t, nc1, []string{"SET", fmt.Sprintf("key:%02d", i), "v"})
+		assert.Equal(t, "+OK", readReply(t, rs[0]))
+	}
+
+	// every page is asked on the other connection
+	var keys []string
+	cursor := "0"
+	for page := 0; ; page++ {
+		send(t, ncs[page%2], []string{"SCAN", cursor, "COUNT", "7"})
+		reply := readReply(t, rs[page%2])
+		reply = strings.TrimSuffix(strings.TrimPrefix(reply, "["), "]")
+		i := strings.IndexByte(reply, ' ')
+		cursor = reply[:i]
+		keys = append(keys, strings.Fields(strings.Trim(reply[i+1:], "[]"))...)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, 30, len(keys))
+	assert.Equal(t, "key:00", keys[0])
+	assert.Equal(t, "key:29", keys[29])
+
+	// an unknown cursor doesn't end the scan quietly
+	send(t, nc2, []string{"SCAN", "123456"})
+	assert.Equal(t, "-ERR invalid cursor", readReply(t, rs[1]))
+}
+
+func TestRandomKey(t *testing.T) {
+	nc := openTestService(t)
+	r := bufio.NewReader(nc)
+	send(t, nc, []string{"RANDOMKEY"})
+	assert.Equal(t, "nil", readReply(t, r))
+
+	for i := 0; i < 20; i++ {
+		send(t, nc, []string{"SET", fmt.Sprintf("key:%02d", i), "v"})
+		assert.Equal(t, "+OK", readReply(t, r))
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		send(t, nc, []string{"RANDOMKEY"})
+		key := readReply(t, r)
+		assert.T(t, strings.HasPrefix(key, "key:"), key)
+		seen[key] = true
+	}
+	assert.T(t, len(seen) > 5, len(seen))
+}
+
+func TestBulkLimit(t *testing.T) {
+	nc := openTestService(t)
+	r := bufio.NewReader(nc)
+
+	// an argument larger than a chunk
+	big := strings.Repeat("v", 3*bulkChunk+1)
+	send(t, nc, []string{"SET", "big", big})
+	assert.Equal(t, "+OK", readReply(t, r))
+	send(t, nc, []string{"GET", "big"})
+	assert.Equal(t, big, readReply(t, r))
+
+	// a length over the largest value is refused before any data
+	_, err := nc.Write([]byte("*1\r\n$536870000\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length", readReply(t, r))
+}
+
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"foo*", "foobar", true},
+		{"foo*", "fo", false},
+		{"f?o", "fao", true},
+		{"*bar", "foobar", true},
+		{"[a-c]x", "bx", true},
+		{"[^a-c]x", "bx", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+	} {
+		assert.Equal(t, tc.match, globMatch(tc.pattern, tc.s))
+	}
+	assert.Equal(t, "user:", globPrefix("user:*"))
+	assert.Equal(t, "a*b", globPrefix("a\\*b?"))
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BackupManifestName is the name of the manifest in a backup, it is written
+// after the files so a backup without it is incomplete.
+const BackupManifestName = "backup.manifest"
+
+// ErrBackupChanged is returned by a backup in read only mode when the writer
+// merged the files while they were backed up, the backup would mix the files
+// from before and after the merge.
+var ErrBackupChanged = errors.New("files changed during the backup")
+
+// errRotateTooSoon is returned when the writeable file can't be rotated in
+// the second it was created in.
+var errRotateTooSoon = errors.New("writeable file created in the current second")
+
+// BackupManifest lists the files of a backup.
+type BackupManifest struct {
+	Created time.Time    `json:"created"`
+	Files   []BackupFile `json:"files"`
+}
+
+// BackupFile is a data or idx file of a backup.
+type BackupFile struct {
+	ID     uint32 `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupSource is a file being backed up, only its first size bytes are.
+type backupSource struct {
+	id   uint32
+	name string
+	fp   *os.File
+	size int64
+}
+
+// Backup writes a consistent copy of the data files as a tar stream to w,
+// while writes go on. The manifest is the last entry of the stream.
+func (storage *Storage) Backup(w io.Writer) (*BackupManifest, error) {
+	sources, release, err := storage.backupSources()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tw := tar.NewWriter(w)
+	manifest := &BackupManifest{Created: time.Now().UTC()}
+	for _, src := range sources {
+		header := &tar.Header{
+			Name:    src.name,
+			Mode:    0644,
+			Size:    src.size,
+			ModTime: manifest.Created,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		sum, err := copySum(tw, src)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{ID: src.id, Name: src.name, Size: src.size, SHA256: sum})
+	}
+	if err := storage.checkSources(sources); err != nil {
+		return nil, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	header := &tar.Header{Name: BackupManifestName, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	storage.Logger.Info("backup finished", zap.Int("files", len(manifest.Files)))
+	return manifest, nil
+}
+
+// BackupDir writes a consistent copy of the data files into dir, which must
+// not exist or be empty, while writes go on. The immutable files are hard
+// linked when dir is on the same file system.
+func (storage *Storage) BackupDir(dir string) (*BackupManifest, error) {
+	if err := emptyDir(dir); err != nil {
+		return nil, err
+	}
+
+	sources, release, err := storage.backupSources()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	manifest := &BackupManifest{Created: time.Now().UTC()}
+	for _, src := range sources {
+		dst := filepath.Join(dir, src.name)
+		var sum string
+		if storage.Config.ReadWrite && os.Link(src.fp.Name(), dst) == nil {
+			// the file is immutable and pinned, it can be shared
+			sum, err = copySum(io.Discard, src)
+		} else {
+			sum, err = copyFile(dst, src)
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, BackupFile{ID: src.id, Name: src.name, Size: src.size, SHA256: sum})
+	}
+	if err := storage.checkSources(sources); err != nil {
+		return nil, err
+	}
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return nil, err
+	}
+	storage.Logger.Info("backup finished", zap.String("dir", dir), zap.Int("files", len(manifest.Files)))
+	return manifest, nil
+}
+
+// backupSources opens the files to back up. In read-write mode the writeable
+// file is rotated first, then the immutable files are pinned against merge
+// until release is called. In read only mode the writer may be elsewhere, so
+// the files are opened all at once and only their current content is backed
+// up, the tail of the last file is repaired when the backup is restored. The
+// writer can't be rotated nor its merges held off from there, checkSources
+// tells whether a merge got in the way.
+func (storage *Storage) backupSources() ([]*backupSource, func(), error) {
+	var ids []uint32
+	if storage.Config.ReadWrite {
+		var err error
+		if ids, err = storage.rotateForBackup(); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var err error
+		if ids, err = immutableFileIDs(storage, ^uint32(0)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var sources []*backupSource
+	release := func() {
+		for _, src := range sources {
+			src.fp.Close()
+		}
+		if storage.Config.ReadWrite {
+			storage.oldFile.unpin(ids...)
+		}
+	}
+	for _, id := range ids {
+		for _, suffix := range []string{BSM, IDX} {
+			name := fmt.Sprintf("%d%s", id, suffix)
+			fp, err := os.Open(filepath.Join(storage.dirFile, name))
+			if err != nil {
+				release()
+				if os.IsNotExist(err) && !storage.Config.ReadWrite {
+					err = fmt.Errorf("%w: %s was merged", ErrBackupChanged, name)
+				}
+				return nil, nil, err
+			}
+			stat, err := fp.Stat()
+			if err != nil {
+				fp.Close()
+				release()
+				return nil, nil, err
+			}
+			sources = append(sources, &backupSource{id: id, name: name, fp: fp, size: stat.Size()})
+		}
+	}
+	return sources, release, nil
+}
+
+// checkSources returns ErrBackupChanged if a merge of the writer replaced or
+// removed a file opened by backupSources in read only mode. The files opened
+// keep their content, so the backup is consistent if none was replaced or
+// removed after it was opened, and no merge is being put in place.
+func (storage *Storage) checkSources(sources []*backupSource) error {
+	if storage.Config.ReadWrite {
+		// the files are pinned
+		return nil
+	}
+	// the manifest of a merge stays until all its files are in place
+	_, err := os.Stat(filepath.Join(storage.dirFile, mergeManifestName))
+	if err == nil {
+		return fmt.Errorf("%w: a merge is being put in place", ErrBackupChanged)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	for _, src := range sources {
+		opened, err := src.fp.Stat()
+		if err != nil {
+			return err
+		}
+		cur, err := os.Stat(src.fp.Name())
+		if os.IsNotExist(err) || (err == nil && !os.SameFile(opened, cur)) {
+			return fmt.Errorf("%w: %s was merged", ErrBackupChanged, src.name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateForBackup rotates the writeable file unless it is empty, and pins
+// and returns the immutable files.
+func (storage *Storage) rotateForBackup() ([]uint32, error) {
+	var ids []uint32
+	for {
+		err := storage.commit(func() error {
+			if storage.writeFile.writeOffset > 0 {
+				if storage.writeFile.fileID >= uint32(time.Now().Unix()) {
+					return errRotateTooSoon
+				}
+				if err := rotateWriteable(storage); err != nil {
+					return err
+				}
+			}
+			var err error
+			if ids, err = immutableFileIDs(storage, storage.writeFile.fileID); err != nil {
+				return err
+			}
+			storage.oldFile.pin(ids...)
+			return nil
+		})
+		if err != errRotateTooSoon {
+			return ids, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// copySum copies the backed up part of src to w and returns its sha256.
+func copySum(w io.Writer, src *backupSource) (string, error) {
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.NewSectionReader(src.fp, 0, src.size))
+	if err != nil {
+		return "", err
+	}
+	if n != src.size {
+		return "", fmt.Errorf("%s: %w", src.name, io.ErrUnexpectedEOF)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFile copies the backed up part of src to the new file dst and returns its sha256.
+func copyFile(dst string, src *backupSource) (string, error) {
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	sum, err := copySum(fp, src)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return sum, err
+}
+
+// writeBackupManifest durably writes the manifest into dir.
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(dir, BackupManifestName+mergeSuffix)
+	fp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(dir, BackupManifestName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readDirNames(dir string) ([]string, error) {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return fp.Readdirnames(-1)
+}
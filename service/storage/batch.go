@@ -0,0 +1,112 @@
+package storage
+
+import "time"
+
+// Batch collects puts and deletes which Storage.Write commits atomically,
+// after a crash either all of them are replayed or none.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key   []byte
+	value []byte
+	meta  uint32
+	ttl   time.Duration
+	del   bool
+}
+
+// NewBatch returns an empty Batch.
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds a put of key/value to the batch, the key expires after
+// Config.ExpirySecs if it is set.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value, ttl: -1})
+}
+
+// PutWithTTL adds a put of key/value which expires after ttl to the batch,
+// a ttl <= 0 never expires.
+func (b *Batch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	b.ops = append(b.ops, batchOp{key: key, value: value, ttl: ttl})
+}
+
+// PutWithMeta adds a put of key/value with meta which expires after ttl to
+// the batch, a ttl <= 0 never expires.
+func (b *Batch) PutWithMeta(key, value []byte, meta uint32, ttl time.Duration) {
+	if ttl < 0 {
+		ttl = 0
+	}
+	b.ops = append(b.ops, batchOp{key: key, value: value, meta: meta, ttl: ttl})
+}
+
+// Del adds a delete of key to the batch.
+func (b *Batch) Del(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, del: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset removes all operations from the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Write commits the batch as a single group in the writeable file and
+// applies it to the EntryCache at once. Deleting a missing key is not an error.
+func (storage *Storage) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	defaultTTL := time.Duration(storage.Config.ExpirySecs) * time.Second
+	recs := make([]record, len(b.ops))
+	keys := make([]string, len(b.ops))
+	for i, op := range b.ops {
+		keys[i] = string(op.key)
+		if op.del {
+			diskKey, flags, err := storage.encodeTombstone(op.key)
+			if err != nil {
+				return err
+			}
+			recs[i] = record{key: diskKey, flags: flags}
+			continue
+		}
+		ttl := op.ttl
+		if ttl < 0 {
+			ttl = defaultTTL
+		}
+		diskKey, data, flags, err := storage.encodeRecord(op.key, op.value, op.meta)
+		if err != nil {
+			return err
+		}
+		recs[i] = record{key: diskKey, value: data, flags: flags, expiry: expiryOf(ttl)}
+	}
+
+	return storage.commit(func() error {
+		if err := checkWriteableFile(storage); err != nil {
+			return err
+		}
+		entries, err := storage.writeFile.writeBatch(recs)
+		if err != nil {
+			return err
+		}
+
+		es := make([]*entry, len(entries))
+		for i := range entries {
+			if !b.ops[i].del {
+				entries[i].Version = storage.nextVersion()
+				es[i] = &entries[i]
+			}
+		}
+		storage.entryCache.Apply(keys, es)
+		return nil
+	})
+}
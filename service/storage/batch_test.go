@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"mousedb/pkg/assert"
+)
+
+func TestWriteBatch(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assert.Nil(t, s.Put([]byte("old"), []byte("value")))
+
+	b := NewBatch()
+	b.Put([]byte("foo"), []byte("bar"))
+	b.Put([]byte("baz"), []byte("qux"))
+	b.Del([]byte("old"))
+	b.Del([]byte("missing"))
+	assert.Nil(t, s.Write(b))
+
+	check := func(s *Storage) {
+		for key, value := range map[string]string{"foo": "bar", "baz": "qux"} {
+			got, err := s.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, value, string(got))
+		}
+		_, err := s.Get([]byte("old"))
+		assert.Equal(t, ErrNotFound, err)
+	}
+	check(s)
+	name := fmt.Sprintf("%s/%d", dir, s.writeFile.fileID)
+	assert.Nil(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	check(s)
+	b.Reset()
+	b.Put([]byte("foo"), []byte("torn"))
+	b.Put([]byte("baz"), []byte("torn"))
+	assert.Nil(t, s.Write(b))
+	assert.Nil(t, s.Close())
+
+	// cut the footer of the last batch, none of its records may be replayed
+	dataStat, err := os.Stat(name + BSM)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(name+BSM, dataStat.Size()-2))
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	check(s)
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+)
+
+// GetWithVersion returns the value of key with its version, the version can
+// be passed to CompareAndSwapVersion and DeleteIfVersion.
+func (storage *Storage) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
+
+	e := storage.entryCache.Get(string(key))
+	if e == nil || e.IsExpired(time.Now()) {
+		return nil, 0, ErrNotFound
+	}
+	value, err := storage.readValue(key, e)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, e.Version, nil
+}
+
+// CompareAndSwap puts key/value only if the current value of key equals old,
+// it returns ErrNotFound if the key doesn't exist and ErrVersionMismatch if
+// the value differs. The key expires after Config.ExpirySecs if it is set.
+func (storage *Storage) CompareAndSwap(key, old, value []byte) error {
+	return storage.commit(func() error {
+		e := storage.liveEntry(key)
+		if e == nil {
+			return ErrNotFound
+		}
+		cur, err := storage.readValue(key, e)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(cur, old) {
+			return ErrVersionMismatch
+		}
+		_, err = storage.put(key, value, 0, time.Duration(storage.Config.ExpirySecs)*time.Second)
+		return err
+	})
+}
+
+// CompareAndSwapVersion puts key/value with meta which expires after ttl only
+// if the current version of key is version, and returns the new version. A
+// ttl <= 0 never expires.
+func (storage *Storage) CompareAndSwapVersion(key []byte, version uint64, value []byte, meta uint32, ttl time.Duration) (uint64, error) {
+	var newVersion uint64
+	err := storage.commit(func() error {
+		e := storage.liveEntry(key)
+		if e == nil {
+			return ErrNotFound
+		}
+		if e.Version != version {
+			return ErrVersionMismatch
+		}
+		var err error
+		newVersion, err = storage.put(key, value, meta, ttl)
+		return err
+	})
+	return newVersion, err
+}
+
+// PutIfAbsent puts key/value with meta which expires after ttl only if key
+// doesn't exist, and returns the new version. It returns ErrKeyExists
+// otherwise. A ttl <= 0 never expires.
+func (storage *Storage) PutIfAbsent(key, value []byte, meta uint32, ttl time.Duration) (uint64, error) {
+	var version uint64
+	err := storage.commit(func() error {
+		if storage.liveEntry(key) != nil {
+			return ErrKeyExists
+		}
+		var err error
+		version, err = storage.put(key, value, meta, ttl)
+		return err
+	})
+	return version, err
+}
+
+// DeleteIfVersion deletes key only if its current version is version.
+func (storage *Storage) DeleteIfVersion(key []byte, version uint64) error {
+	return storage.commit(func() error {
+		e := storage.liveEntry(key)
+		if e == nil {
+			return ErrNotFound
+		}
+		if e.Version != version {
+			return ErrVersionMismatch
+		}
+		return storage.del(key)
+	})
+}
+
+// liveEntry returns the entry of key if it exists and has not expired.
+func (storage *Storage) liveEntry(key []byte) *entry {
+	e := storage.entryCache.Get(string(key))
+	if e == nil || e.IsExpired(time.Now()) {
+		return nil
+	}
+	return e
+}
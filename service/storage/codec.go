@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// the codec of a value is kept in the flags of its record, so files written
+// with different codecs stay readable
+const (
+	flagCodecShift        = 8
+	flagCodecMask  uint32 = 0xff << flagCodecShift
+)
+
+// ErrUnknownCodec is returned when a value is encoded by a codec which isn't registered.
+var ErrUnknownCodec = fmt.Errorf("unknown codec")
+
+// Codec compresses the values written to the data files.
+type Codec interface {
+	// ID is stored in the record of every value encoded by the codec, it must
+	// be unique, stable and within 1..255. 0 is the raw value.
+	ID() uint8
+	// Name is the name of the codec in Config.Compression.
+	Name() string
+	Encode(value []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+var (
+	codecsLock   sync.RWMutex
+	codecsByID   = make(map[uint8]Codec)
+	codecsByName = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(deflateCodec{})
+	RegisterCodec(gzipCodec{})
+}
+
+// RegisterCodec makes a codec available to Config.Compression and to the
+// values written by it.
+func RegisterCodec(c Codec) error {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if c.ID() == 0 {
+		return fmt.Errorf("codec %s: id 0 is reserved", c.Name())
+	}
+	if _, ok := codecsByID[c.ID()]; ok {
+		return fmt.Errorf("codec %s: id %d is registered already", c.Name(), c.ID())
+	}
+	if _, ok := codecsByName[c.Name()]; ok {
+		return fmt.Errorf("codec %s is registered already", c.Name())
+	}
+	codecsByID[c.ID()] = c
+	codecsByName[c.Name()] = c
+	return nil
+}
+
+// codecByName returns the codec of name, nil for "none" or "".
+func codecByName(name string) (Codec, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecsByName[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// encodeValue compresses value with the configured codec if it is large
+// enough and gets smaller, and returns the flags of the record.
+func (storage *Storage) encodeValue(value []byte) ([]byte, uint32, error) {
+	c := storage.codec
+	if c == nil || len(value) < storage.Config.CompressionMinSize {
+		return value, 0, nil
+	}
+	data, err := c.Encode(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) >= len(value) {
+		return value, 0, nil
+	}
+	return data, uint32(c.ID()) << flagCodecShift, nil
+}
+
+// decodeValue returns the value of data read from a record with flags.
+func decodeValue(flags uint32, data []byte) ([]byte, error) {
+	id := uint8((flags & flagCodecMask) >> flagCodecShift)
+	if id == 0 {
+		return data, nil
+	}
+	codecsLock.RLock()
+	c, ok := codecsByID[id]
+	codecsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: id %d", ErrUnknownCodec, id)
+	}
+	return c.Decode(data)
+}
+
+// deflateCodec compresses with DEFLATE (RFC 1951).
+type deflateCodec struct{}
+
+func (deflateCodec) ID() uint8    { return 1 }
+func (deflateCodec) Name() string { return "deflate" }
+
+func (deflateCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) Decode(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// gzipCodec compresses with gzip (RFC 1952).
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8    { return 2 }
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Encode(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -9,12 +9,16 @@ import (
 )
 
 const (
-	defaultExpirySecs    = 0       // 默认的过期时间
-	defaultMaxFileSize   = 1 << 31 // // 最大文件大小 2G
-	defaultTimeoutSecs   = 10      // 超时时间
-	defaultValueMaxSize  = 1 << 20 // Value的最大大小
-	defaultMergeSecs     = 60      // 合并策略
-	defaultCheckSumCrc32 = false   //是否使用 CRC32 校验
+	defaultExpirySecs         = 0            // 默认的过期时间
+	defaultMaxFileSize        = 1 << 31      // // 最大文件大小 2G
+	defaultTimeoutSecs        = 10           // 超时时间
+	defaultValueMaxSize       = 1 << 20      // Value的最大大小
+	defaultMergeSecs          = 60           // 合并策略
+	defaultCheckSumCrc32      = false        //是否使用 CRC32 校验
+	defaultCompression        = "none"       // 值的压缩算法
+	defaultCompressionMinSize = 256          // 小于该大小的值不压缩
+	defaultSyncMode           = SyncInterval // 写入落盘策略
+	defaultFsyncIntervalMs    = 1000         // interval 模式下的落盘间隔
 )
 
 type Config struct {
@@ -23,9 +27,30 @@ type Config struct {
 	OpenTimeoutSecs int    `json:"open-timeout-secs,omitempty"`
 	ReadWrite       bool   `json:"read-write,omitempty"`
 	MergeSecs       int    `json:"merge-secs,omitempty"`
-	CheckSumCrc32   bool   `json:"check-sum-crc-32,omitempty"`
-	ValueMaxSize    uint64 `json:"value-max-size,omitempty"`
-	Dir             string `json:"dir,omitempty"`
+	// RefreshSecs is how often a read only storage loads the records appended
+	// by the writer, 0 only loads them on Refresh.
+	RefreshSecs   int  `json:"refresh-secs,omitempty"`
+	CheckSumCrc32 bool `json:"check-sum-crc-32,omitempty"`
+	// MmapReads maps the immutable data files into memory, so reading them
+	// doesn't need a syscall and GetView can return values without a copy.
+	MmapReads    bool   `json:"mmap-reads,omitempty"`
+	ValueMaxSize uint64 `json:"value-max-size,omitempty"`
+	// SyncMode tells when the writes are synced to disk: always before a
+	// write returns, every FsyncIntervalMs on interval, or never on none.
+	SyncMode        string `json:"sync-mode,omitempty"`
+	FsyncIntervalMs int    `json:"fsync-interval-ms,omitempty"`
+	// Compression is the codec of the values: none, deflate, gzip or a
+	// codec added by RegisterCodec. Values smaller than CompressionMinSize
+	// are written raw.
+	Compression        string `json:"compression,omitempty"`
+	CompressionMinSize int    `json:"compression-min-size,omitempty"`
+	// The AES-GCM keys encrypting the keys and values at rest are read from
+	// EncryptionKeyFile, or from the environment variable EncryptionKeyEnv.
+	// Every key is written as <id>:<hex key>, one per line, the highest id
+	// encrypts new records and merge encrypts the older records with it.
+	EncryptionKeyFile string `json:"encryption-key-file,omitempty"`
+	EncryptionKeyEnv  string `json:"encryption-key-env,omitempty"`
+	Dir               string `json:"dir,omitempty"`
 }
 
 func NewConfig() *Config {
@@ -37,6 +62,10 @@ func NewConfig() *Config {
 	c.MergeSecs = defaultMergeSecs
 	c.CheckSumCrc32 = defaultCheckSumCrc32
 	c.ValueMaxSize = defaultValueMaxSize
+	c.Compression = defaultCompression
+	c.SyncMode = defaultSyncMode
+	c.FsyncIntervalMs = defaultFsyncIntervalMs
+	c.CompressionMinSize = defaultCompressionMinSize
 	return c
 }
 
@@ -57,15 +86,45 @@ func (c *Config) DefaultDir() error {
 
 func (c *Config) Validate() error {
 	if c.ExpirySecs < 0 {
-		errors.New("expiry_secs can't less than 0")
+		return errors.New("expiry_secs can't less than 0")
 	}
 
 	if c.MaxFileSize <= 0 {
-		errors.New("max-file-size can't less than or equal 0")
+		return errors.New("max-file-size can't less than or equal 0")
 	}
 
 	if c.OpenTimeoutSecs < 0 {
-		errors.New("timeout-secs can't less than 0")
+		return errors.New("timeout-secs can't less than 0")
+	}
+
+	if c.MergeSecs < 0 {
+		return errors.New("merge-secs can't less than 0")
+	}
+
+	if c.RefreshSecs < 0 {
+		return errors.New("refresh-secs can't less than 0")
+	}
+
+	switch c.SyncMode {
+	case SyncAlways, SyncNone:
+	case SyncInterval:
+		if c.FsyncIntervalMs <= 0 {
+			return errors.New("fsync-interval-ms can't less than or equal 0")
+		}
+	default:
+		return fmt.Errorf("sync-mode %q: want always, interval or none", c.SyncMode)
+	}
+
+	if _, err := codecByName(c.Compression); err != nil {
+		return fmt.Errorf("compression: %v", err)
+	}
+
+	if c.CompressionMinSize < 0 {
+		return errors.New("compression-min-size can't less than 0")
+	}
+
+	if c.EncryptionKeyFile != "" && c.EncryptionKeyEnv != "" {
+		return errors.New("encryption-key-file and encryption-key-env can't be both set")
 	}
 	return nil
 }
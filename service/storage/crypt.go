@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the id of the key which encrypted a record is kept in its flags, 0 is a
+// plaintext record
+const (
+	flagKeyShift        = 16
+	flagKeyMask  uint32 = 0xff << flagKeyShift
+)
+
+// ErrDecrypt is returned when an encrypted record can't be decrypted or authenticated.
+var ErrDecrypt = fmt.Errorf("decrypt record failed")
+
+// keyring holds the AES-GCM keys of the encrypted records. The key with the
+// highest id encrypts the new records, the others are only kept to read the
+// records written before a rotation, until merge encrypts them again.
+type keyring struct {
+	current uint8
+	aeads   map[uint8]cipher.AEAD
+}
+
+// loadKeyring reads the keys from Config.EncryptionKeyFile or from the
+// environment variable Config.EncryptionKeyEnv, it returns nil if encryption
+// is not configured.
+func loadKeyring(c *Config) (*keyring, error) {
+	var text string
+	switch {
+	case c.EncryptionKeyFile != "":
+		data, err := os.ReadFile(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	case c.EncryptionKeyEnv != "":
+		text = os.Getenv(c.EncryptionKeyEnv)
+		if text == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", c.EncryptionKeyEnv)
+		}
+	default:
+		return nil, nil
+	}
+	return parseKeyring(text)
+}
+
+// parseKeyring parses keys written as "<id>:<hex key>", separated by new
+// lines or commas. An id is within 1..255, a key is 16, 24 or 32 bytes long
+// for AES-128, AES-192 or AES-256. Lines starting with # are ignored.
+func parseKeyring(text string) (*keyring, error) {
+	kr := &keyring{aeads: make(map[uint8]cipher.AEAD)}
+	fields := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+		idText, keyText, ok := strings.Cut(field, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %q: want <id>:<hex key>", field)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idText), 10, 8)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("encryption key id %q: want 1..255", idText)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(keyText))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %d: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := kr.aeads[uint8(id)]; ok {
+			return nil, fmt.Errorf("encryption key %d is duplicated", id)
+		}
+		kr.aeads[uint8(id)] = aead
+		if uint8(id) > kr.current {
+			kr.current = uint8(id)
+		}
+	}
+	if len(kr.aeads) == 0 {
+		return nil, fmt.Errorf("no encryption key")
+	}
+	return kr, nil
+}
+
+// sealRecord encrypts the key and value of a record with the current key and
+// returns them with flags carrying the key id. The value is bound to its key,
+// so it can't be moved to another record.
+func (kr *keyring) sealRecord(key, value []byte, flags uint32) ([]byte, []byte, uint32, error) {
+	sealedKey, err := kr.seal(key, nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sealedValue, err := kr.seal(value, key)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return sealedKey, sealedValue, kr.flags(flags), nil
+}
+
+// sealKey encrypts a key with the current key and returns it with flags carrying the key id.
+func (kr *keyring) sealKey(key []byte, flags uint32) ([]byte, uint32, error) {
+	sealedKey, err := kr.seal(key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sealedKey, kr.flags(flags), nil
+}
+
+func (kr *keyring) flags(flags uint32) uint32 {
+	return flags&^flagKeyMask | uint32(kr.current)<<flagKeyShift
+}
+
+// seal returns nonce + ciphertext + tag of plaintext.
+func (kr *keyring) seal(plaintext, aad []byte) ([]byte, error) {
+	aead := kr.aeads[kr.current]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// open decrypts and authenticates data of a record with flags, the data of a
+// plaintext record is returned as it is. A nil keyring only opens plaintext records.
+func (kr *keyring) open(flags uint32, data, aad []byte) ([]byte, error) {
+	id := uint8((flags & flagKeyMask) >> flagKeyShift)
+	if id == 0 {
+		return data, nil
+	}
+	var aead cipher.AEAD
+	if kr != nil {
+		aead = kr.aeads[id]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: no encryption key %d", ErrDecrypt, id)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %d: %v", ErrDecrypt, id, err)
+	}
+	return plaintext, nil
+}
+
+// stale returns whether merge has to encrypt a record with flags again,
+// because it is in plaintext or encrypted by an older key.
+func (kr *keyring) stale(flags uint32) bool {
+	return kr != nil && uint8((flags&flagKeyMask)>>flagKeyShift) != kr.current
+}
+
+// encodeRecord prefixes value by meta, compresses then encrypts key/value as
+// configured, and returns them as written to the data file with the flags of
+// the record.
+func (storage *Storage) encodeRecord(key, value []byte, meta uint32) ([]byte, []byte, uint32, error) {
+	value, metaFlags := withMeta(value, meta)
+	data, flags, err := storage.encodeValue(value)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	flags |= metaFlags
+	if storage.keys == nil {
+		return key, data, flags, nil
+	}
+	return storage.keys.sealRecord(key, data, flags)
+}
+
+// encodeTombstone returns the key of a tombstone as written to the data file with its flags.
+func (storage *Storage) encodeTombstone(key []byte) ([]byte, uint32, error) {
+	if storage.keys == nil {
+		return key, flagTombstone, nil
+	}
+	return storage.keys.sealKey(key, flagTombstone)
+}
+
+// openIdxKeys decrypts the keys of the encrypted idx records in place.
+func (storage *Storage) openIdxKeys(recs []*idxRecord) error {
+	for _, rec := range recs {
+		key, err := storage.keys.open(rec.Flags, rec.Key, nil)
+		if err != nil {
+			return err
+		}
+		rec.Key = key
+	}
+	return nil
+}
+
+// reseal encrypts the raw data record buf of key again with the current key,
+// and returns the new raw record.
+func (storage *Storage) reseal(buf []byte, key []byte) ([]byte, error) {
+	_, tStamp, _, _, flags, expiry, _, value, err := decodeEntryDetail(buf)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = storage.keys.open(flags, value, key); err != nil {
+		return nil, err
+	}
+	sealedKey, sealedValue, flags, err := storage.keys.sealRecord(key, value, flags)
+	if err != nil {
+		return nil, err
+	}
+	return encodeEntry(tStamp, uint32(len(sealedKey)), uint32(len(sealedValue)), flags, expiry, sealedKey, sealedValue), nil
+}
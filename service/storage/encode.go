@@ -9,13 +9,15 @@ import (
 // ErrCrc32 is returned when the CRC32 checksum fails.
 var ErrCrc32 = errors.New("checksumIEEE error")
 
-// encodeEntry encodes a timestamp, key size, value size, key and value into a byte slice.
-func encodeEntry(timestamp, keySize, valueSize uint32, key, value []byte) []byte {
+// encodeEntry encodes a timestamp, key size, value size, flags, expiry, key and value into a byte slice.
+func encodeEntry(timestamp, keySize, valueSize, flags, expiry uint32, key, value []byte) []byte {
 	bufSize := HeaderSize + keySize + valueSize
 	buf := make([]byte, bufSize)
 	binary.LittleEndian.PutUint32(buf[4:8], timestamp)
 	binary.LittleEndian.PutUint32(buf[8:12], keySize)
 	binary.LittleEndian.PutUint32(buf[12:16], valueSize)
+	binary.LittleEndian.PutUint32(buf[16:20], flags)
+	binary.LittleEndian.PutUint32(buf[20:24], expiry)
 	copy(buf[HeaderSize:(HeaderSize+keySize)], key)
 	copy(buf[(HeaderSize+keySize):(HeaderSize+keySize+valueSize)], value)
 
@@ -26,9 +28,8 @@ func encodeEntry(timestamp, keySize, valueSize uint32, key, value []byte) []byte
 
 // DecodeEntry decodes a byte slice into a value.
 func DecodeEntry(buf []byte) ([]byte, error) {
-	c32 := binary.LittleEndian.Uint32(buf[:4])
-	if crc32.ChecksumIEEE(buf[4:]) != c32 {
-		return nil, ErrCrc32
+	if err := verifyEntry(buf); err != nil {
+		return nil, err
 	}
 	ksz := binary.LittleEndian.Uint32(buf[8:12])
 	valuesz := binary.LittleEndian.Uint32(buf[12:16])
@@ -37,50 +38,63 @@ func DecodeEntry(buf []byte) ([]byte, error) {
 	return value, nil
 }
 
+// verifyEntry checks the crc32 of an encoded entry.
+func verifyEntry(buf []byte) error {
+	if crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf[:4]) {
+		return ErrCrc32
+	}
+	return nil
+}
+
 // DecodeEntryHeader decodes a byte slice into a header.
-func DecodeEntryHeader(buf []byte) (uint32, uint32, uint32, uint32) {
+func DecodeEntryHeader(buf []byte) (uint32, uint32, uint32, uint32, uint32, uint32) {
 	c32 := binary.LittleEndian.Uint32(buf[:4])
 	tStamp := binary.LittleEndian.Uint32(buf[4:8])
 	ksz := binary.LittleEndian.Uint32(buf[8:12])
 	valuesz := binary.LittleEndian.Uint32(buf[12:16])
-	return c32, tStamp, ksz, valuesz
+	flags := binary.LittleEndian.Uint32(buf[16:20])
+	expiry := binary.LittleEndian.Uint32(buf[20:24])
+	return c32, tStamp, ksz, valuesz, flags, expiry
 }
 
 // decodeEntryDetail decodes a byte slice into a detailed entry.
-func decodeEntryDetail(buf []byte) (uint32, uint32, uint32, uint32, []byte, []byte, error) {
+func decodeEntryDetail(buf []byte) (uint32, uint32, uint32, uint32, uint32, uint32, []byte, []byte, error) {
 	c32 := binary.LittleEndian.Uint32(buf[:4])
 	if crc32.ChecksumIEEE(buf[4:]) != c32 {
-		return c32, 0, 0, 0, nil, nil, ErrCrc32
+		return c32, 0, 0, 0, 0, 0, nil, nil, ErrCrc32
 	}
 	tStamp := binary.LittleEndian.Uint32(buf[4:8])
 	ksz := binary.LittleEndian.Uint32(buf[8:12])
 	valuesz := binary.LittleEndian.Uint32(buf[12:16])
-	if ksz+valuesz == 0 {
-		return c32, tStamp, ksz, valuesz, nil, nil, nil
-	}
+	flags := binary.LittleEndian.Uint32(buf[16:20])
+	expiry := binary.LittleEndian.Uint32(buf[20:24])
 	key := make([]byte, ksz)
 	value := make([]byte, valuesz)
 	copy(key, buf[HeaderSize:HeaderSize+ksz])
 	copy(value, buf[(HeaderSize+ksz):(HeaderSize+ksz+valuesz)])
-	return c32, tStamp, ksz, valuesz, key, value, nil
+	return c32, tStamp, ksz, valuesz, flags, expiry, key, value, nil
 }
 
 // EncodeIdx encodes a idx record.
-func EncodeIdx(tStamp, ksz, valueSz uint32, valuePos uint64, key []byte) []byte {
+func EncodeIdx(tStamp, ksz, valueSz uint32, valuePos uint64, flags, expiry uint32, key []byte) []byte {
 	buf := make([]byte, IdxHeaderSize+len(key))
 	binary.LittleEndian.PutUint32(buf[0:4], tStamp)
 	binary.LittleEndian.PutUint32(buf[4:8], ksz)
 	binary.LittleEndian.PutUint32(buf[8:12], valueSz)
-	binary.LittleEndian.PutUint64(buf[12:IdxHeaderSize], valuePos)
+	binary.LittleEndian.PutUint64(buf[12:20], valuePos)
+	binary.LittleEndian.PutUint32(buf[20:24], flags)
+	binary.LittleEndian.PutUint32(buf[24:IdxHeaderSize], expiry)
 	copy(buf[IdxHeaderSize:], key)
 	return buf
 }
 
 // DecodeIdx decodes a idx record.
-func DecodeIdx(buf []byte) (tStamp, ksz, valueSz uint32, valuePos uint64) {
+func DecodeIdx(buf []byte) (tStamp, ksz, valueSz uint32, valuePos uint64, flags, expiry uint32) {
 	tStamp = binary.LittleEndian.Uint32(buf[:4])
 	ksz = binary.LittleEndian.Uint32(buf[4:8])
 	valueSz = binary.LittleEndian.Uint32(buf[8:12])
-	valuePos = binary.LittleEndian.Uint64(buf[12:IdxHeaderSize])
-	return tStamp, ksz, valueSz, valuePos
+	valuePos = binary.LittleEndian.Uint64(buf[12:20])
+	flags = binary.LittleEndian.Uint32(buf[20:24])
+	expiry = binary.LittleEndian.Uint32(buf[24:IdxHeaderSize])
+	return tStamp, ksz, valueSz, valuePos, flags, expiry
 }
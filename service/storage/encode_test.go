@@ -19,8 +19,9 @@ func TestEncodeDecodeEntry(t *testing.T) {
 	binary.LittleEndian.PutUint32(buf[4:8], tStamp)
 	binary.LittleEndian.PutUint32(buf[8:12], ksz)
 	binary.LittleEndian.PutUint32(buf[12:16], valuesz)
-	copy(buf[16:(16+ksz)], key)
-	copy(buf[(16+ksz):(16+ksz+valuesz)], value)
+	binary.LittleEndian.PutUint32(buf[16:20], flagTombstone)
+	copy(buf[HeaderSize:(HeaderSize+ksz)], key)
+	copy(buf[(HeaderSize+ksz):(HeaderSize+ksz+valuesz)], value)
 	c32 := crc32.ChecksumIEEE(buf[4:])
 	binary.LittleEndian.PutUint32(buf[0:4], uint32(c32))
 
@@ -33,9 +34,29 @@ func TestEncodeDecodeEntry(t *testing.T) {
 	assert.Equal(t, binary.LittleEndian.Uint32(buf[4:8]), tStamp)
 	assert.Equal(t, binary.LittleEndian.Uint32(buf[8:12]), ksz)
 	assert.Equal(t, binary.LittleEndian.Uint32(buf[12:16]), valuesz)
+	assert.Equal(t, binary.LittleEndian.Uint32(buf[16:20]), flagTombstone)
 	assert.Equal(t, buf[HeaderSize:(HeaderSize+ksz)], key)
 	assert.Equal(t, buf[(HeaderSize+ksz):(HeaderSize+ksz+valuesz)], value)
 
+	// encodeEntry/decodeEntryDetail, tombstone
+	buf = encodeEntry(tStamp, ksz, 0, flagTombstone, 0, key, nil)
+	_, ts, dksz, dvaluesz, flags, expiry, dkey, _, err := decodeEntryDetail(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, tStamp, ts)
+	assert.Equal(t, ksz, dksz)
+	assert.Equal(t, uint32(0), dvaluesz)
+	assert.Equal(t, flagTombstone, flags)
+	assert.Equal(t, uint32(0), expiry)
+	assert.Equal(t, key, dkey)
+
+	// encodeEntry/decodeEntryDetail, expiry
+	buf = encodeEntry(tStamp, ksz, valuesz, 0, tStamp+60, key, value)
+	_, _, _, _, _, expiry, dkey, dvalue, err := decodeEntryDetail(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, tStamp+60, expiry)
+	assert.Equal(t, key, dkey)
+	assert.Equal(t, value, dvalue)
+
 	// EncodeEntry , ksz = 0, valueSz = 0
 	ksz = uint32(0)
 	valuesz = uint32(0)
@@ -72,6 +93,17 @@ func TestEncodeDecodeIdx(t *testing.T) {
 	assert.Equal(t, binary.LittleEndian.Uint64(buf[12:20]), valuePos)
 	assert.Equal(t, buf[IdxHeaderSize:], key)
 
+	// EncodeIdx/DecodeIdx, tombstone keeps the key
+	buf = EncodeIdx(tStamp, ksz, 0, valuePos, flagTombstone, tStamp+60, key)
+	dtStamp, dksz, dvaluesz, dvaluePos, flags, expiry := DecodeIdx(buf)
+	assert.Equal(t, tStamp, dtStamp)
+	assert.Equal(t, ksz, dksz)
+	assert.Equal(t, uint32(0), dvaluesz)
+	assert.Equal(t, valuePos, dvaluePos)
+	assert.Equal(t, flagTombstone, flags)
+	assert.Equal(t, tStamp+60, expiry)
+	assert.Equal(t, key, buf[IdxHeaderSize:])
+
 	ksz = 0
 	valuesz = 0
 	valuePos = 0
@@ -1,13 +1,20 @@
 package storage
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // entry represents a key-value pair in mousedb
 type entry struct {
 	FileID      uint32 // ID of the file containing the value
+	KeySize     uint32 // Size of the key on disk in bytes, larger than the key when it is encrypted
 	ValueSize   uint32 // Size of the value in bytes
 	ValueOffset uint64 // Offset of the value in the data block
 	Timestamp   uint32 // Unix timestamp of the file access time
+	Expiry      uint32 // Unix timestamp the value expires at, 0 never expires
+	Version     uint64 // Version of the value, changed by every write of the key, kept in memory only
+	Flags       uint32 // Flags of the record, they tell how the value is encoded
 }
 
 // String returns a string representation of the entry
@@ -16,6 +23,11 @@ func (e *entry) String() string {
 		e.FileID, e.ValueSize, e.ValueOffset)
 }
 
+// IsExpired returns true if the entry has expired at now
+func (e *entry) IsExpired(now time.Time) bool {
+	return e.Expiry != 0 && uint32(now.Unix()) >= e.Expiry
+}
+
 // IsNewerThan returns true if the entry is newer than the old entry
 func (e *entry) IsNewerThan(old *entry) bool {
 	if e.Timestamp > old.Timestamp ||
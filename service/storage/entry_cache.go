@@ -1,60 +1,269 @@
 package storage
 
-import "sync"
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
 
-// EntryCache for HashMap
+const (
+	// the number of independently locked shards of the keydir, at most 64
+	keydirShards = 16
+	// the size of the chunks the keys of a shard are packed in
+	keyChunkSize = 64 << 10
+	// keys longer than this get an allocation of their own
+	maxChunkedKey = keyChunkSize / 16
+)
+
+// EntryCache for the keydir, ordered by key. The keys are spread by hash
+// over shards locked on their own, every shard is a persistent treap whose
+// nodes hold the entries by value, and whose keys are packed into chunks.
 type EntryCache struct {
+	shards [keydirShards]keydirShard
+}
+
+// keydirShard is a shard of the keydir.
+type keydirShard struct {
 	sync.RWMutex
-	entries map[string]*entry
+	root     *node // persistent treap, replaced on every update
+	size     int
+	keyBytes int       // bytes of the keys in the treap
+	keys     *keyArena // where the new keys are copied to
 }
 
+// keydirView is the roots of all the shards of the keydir at a point in
+// time, it is never changed by later updates.
+type keydirView [keydirShards]*node
+
 // NewEntryCache creates a new EntryCache object
 func NewEntryCache() *EntryCache {
-	return &EntryCache{
-		entries: make(map[string]*entry),
+	k := &EntryCache{}
+	for i := range k.shards {
+		k.shards[i].keys = &keyArena{chunkBytes: new(int64)}
 	}
+	return k
+}
+
+// shardOf returns the shard of the key with the given priority.
+func shardOf(priority uint64) int {
+	return int(priority & (keydirShards - 1))
 }
 
 // Get retrieves the value associated with the given key
 func (k *EntryCache) Get(key string) *entry {
-	k.RLock()
-	defer k.RUnlock()
-	return k.entries[key]
+	s := &k.shards[shardOf(keyPriority(key))]
+	s.RLock()
+	n := treapGet(s.root, key)
+	s.RUnlock()
+	if n != nil {
+		return &n.e
+	}
+	return nil
+}
+
+// Root returns the current roots of the keydir, they are taken at once
+// across all shards, so a batch is either entirely in them or not at all.
+func (k *EntryCache) Root() keydirView {
+	var v keydirView
+	for i := range k.shards {
+		k.shards[i].RLock()
+	}
+	for i := range k.shards {
+		v[i] = k.shards[i].root
+		k.shards[i].RUnlock()
+	}
+	return v
+}
+
+// Len returns the number of keys in EntryCache
+func (k *EntryCache) Len() int {
+	size := 0
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.RLock()
+		size += s.size
+		s.RUnlock()
+	}
+	return size
 }
 
 // Del removes the entry associated with the given key
 func (k *EntryCache) Del(key string) {
-	k.Lock()
-	defer k.Unlock()
-	delete(k.entries, key)
+	priority := keyPriority(key)
+	s := &k.shards[shardOf(priority)]
+	s.Lock()
+	defer s.Unlock()
+	s.del(key)
 }
 
 // Put inserts a new key-value entry into the EntryCache
 func (k *EntryCache) Put(key string, e *entry) {
-	k.Lock()
-	defer k.Unlock()
-	k.entries[key] = e
+	priority := keyPriority(key)
+	s := &k.shards[shardOf(priority)]
+	s.Lock()
+	defer s.Unlock()
+	s.put(key, e, priority)
+}
+
+// Apply puts es[i] as the entry of keys[i] under the locks of all the shards
+// involved, a nil entry deletes the key
+func (k *EntryCache) Apply(keys []string, es []*entry) {
+	priorities := make([]uint64, len(keys))
+	var locked uint64
+	for i, key := range keys {
+		priorities[i] = keyPriority(key)
+		locked |= 1 << shardOf(priorities[i])
+	}
+	// the shards are always locked in order
+	for i := range k.shards {
+		if locked&(1<<i) != 0 {
+			k.shards[i].Lock()
+		}
+	}
+	for i, key := range keys {
+		s := &k.shards[shardOf(priorities[i])]
+		if es[i] == nil {
+			s.del(key)
+			continue
+		}
+		s.put(key, es[i], priorities[i])
+	}
+	for i := range k.shards {
+		if locked&(1<<i) != 0 {
+			k.shards[i].Unlock()
+		}
+	}
+}
+
+// SetCompare replaces the entry of key with e only if it still equals old,
+// it returns false when the key has been rewritten or deleted in the meantime
+func (k *EntryCache) SetCompare(key string, old, e *entry) bool {
+	priority := keyPriority(key)
+	s := &k.shards[shardOf(priority)]
+	s.Lock()
+	defer s.Unlock()
+	cur := treapGet(s.root, key)
+	if cur == nil || !cur.e.IsEqualTo(old) {
+		return false
+	}
+	s.put(key, e, priority)
+	return true
+}
+
+// DelCompare removes the entry of key only if it still equals old
+func (k *EntryCache) DelCompare(key string, old *entry) bool {
+	s := &k.shards[shardOf(keyPriority(key))]
+	s.Lock()
+	defer s.Unlock()
+	cur := treapGet(s.root, key)
+	if cur == nil || !cur.e.IsEqualTo(old) {
+		return false
+	}
+	s.del(key)
+	return true
 }
 
-// SetCompare compares the given entry with the existing entry in EntryCache and updates the value if necessary
-func (k *EntryCache) SetCompare(key string, e *entry) bool {
-	k.Lock()
-	defer k.Unlock()
-	old, ok := k.entries[key]
-	if !ok || e.IsEqualTo(old) {
-		k.entries[key] = e
-		return true
+// Replace makes the keys of o the keys of EntryCache, o must not be used afterwards
+func (k *EntryCache) Replace(o *EntryCache) {
+	for i := range k.shards {
+		k.shards[i].Lock()
+	}
+	for i := range k.shards {
+		s, from := &k.shards[i], &o.shards[i]
+		from.RLock()
+		s.root, s.size, s.keyBytes, s.keys = from.root, from.size, from.keyBytes, from.keys
+		from.RUnlock()
+		s.Unlock()
 	}
-	return false
 }
 
 // UpdateFileID updates the file ID for all entries in EntryCache that have the given old ID
 func (k *EntryCache) UpdateFileID(oldID, newID uint32) {
-	k.Lock()
-	defer k.Unlock()
-	for _, e := range k.entries {
-		if e.FileID == oldID {
-			e.FileID = newID
-		}
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.Lock()
+		treapWalk(s.root, func(n *node) bool {
+			if n.e.FileID == oldID {
+				e := n.e
+				e.FileID = newID
+				s.put(n.key, &e, n.priority)
+			}
+			return true
+		})
+		s.Unlock()
+	}
+}
+
+// keydirMemory is the memory held by the keydir.
+type keydirMemory struct {
+	keys       uint64
+	keyBytes   uint64 // bytes of the keys
+	arenaBytes uint64 // bytes of the key chunks still referenced, deleted keys included
+	nodeBytes  uint64 // bytes of the treap nodes
+}
+
+// memory returns the memory held by the current keydir. Older versions of
+// the nodes kept by snapshots and iterators are not counted.
+func (k *EntryCache) memory() keydirMemory {
+	var m keydirMemory
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.RLock()
+		m.keys += uint64(s.size)
+		m.keyBytes += uint64(s.keyBytes)
+		m.arenaBytes += uint64(atomic.LoadInt64(s.keys.chunkBytes))
+		s.RUnlock()
+	}
+	m.nodeBytes = m.keys * uint64(unsafe.Sizeof(node{}))
+	return m
+}
+
+func (s *keydirShard) put(key string, e *entry, priority uint64) {
+	if treapGet(s.root, key) == nil {
+		// the node of a new key keeps its key, it is worth packing
+		key = s.keys.copy(key)
+		s.keyBytes += len(key)
+		s.size++
+	}
+	s.root, _ = treapInsert(s.root, key, e, priority)
+}
+
+func (s *keydirShard) del(key string) {
+	var ok bool
+	s.root, ok = treapDelete(s.root, key)
+	if ok {
+		s.size--
+		s.keyBytes -= len(key)
+	}
+}
+
+// keyArena packs keys into chunks, so a key costs its bytes rather than an
+// allocation of its own. The bytes of a deleted key are reclaimed with its
+// chunk, once no key of the chunk is left.
+type keyArena struct {
+	chunk []byte
+	// bytes of the chunks not collected yet, updated atomically. It is apart
+	// from the arena, so the finalizers of the chunks don't keep the last one
+	chunkBytes *int64
+}
+
+// copy returns a copy of key, it shares its memory with the keys copied before.
+func (a *keyArena) copy(key string) string {
+	if len(key) == 0 || len(key) > maxChunkedKey {
+		return key
+	}
+	if cap(a.chunk)-len(a.chunk) < len(key) {
+		chunk, chunkBytes := new([keyChunkSize]byte), a.chunkBytes
+		atomic.AddInt64(chunkBytes, keyChunkSize)
+		runtime.SetFinalizer(chunk, func(*[keyChunkSize]byte) {
+			atomic.AddInt64(chunkBytes, -keyChunkSize)
+		})
+		a.chunk = chunk[:0]
 	}
+	start := len(a.chunk)
+	a.chunk = append(a.chunk, key...)
+	b := a.chunk[start:len(a.chunk):len(a.chunk)]
+	// the bytes of b are never written again
+	return *(*string)(unsafe.Pointer(&b))
 }
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// The formats of Export and Import.
+const (
+	FormatJSONL = "jsonl" // one JSON object per line
+	FormatCSV   = "csv"   // a header line, then one line per key
+)
+
+// the number of puts Import writes in one batch by default
+const defaultImportBatchSize = 1000
+
+// ErrFormat is returned for an unknown export format.
+var ErrFormat = fmt.Errorf("unknown export format")
+
+// csvHeader names the columns of the CSV format, the files exported before
+// the meta column are imported too.
+var csvHeader = []string{"key", "value", "encoding", "timestamp", "expires_at", "meta"}
+
+// exportLine is a key exported with its metadata. Key and value are kept as
+// text when both are valid UTF-8, otherwise both are base64 encoded and
+// Encoding is "base64". Timestamp is the unix time of the last write of the
+// key, ExpiresAt the unix time it expires at, 0 never expires. Meta is the
+// meta of the value, see PutWithMeta.
+type exportLine struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Encoding  string `json:"encoding,omitempty"`
+	Timestamp uint32 `json:"timestamp,omitempty"`
+	ExpiresAt uint32 `json:"expires_at,omitempty"`
+	Meta      uint32 `json:"meta,omitempty"`
+}
+
+// ExportOptions tunes an Export.
+type ExportOptions struct {
+	Format string // FormatJSONL or FormatCSV, FormatJSONL if empty
+	Prefix []byte // only export the keys starting with Prefix
+}
+
+// ImportOptions tunes an Import.
+type ImportOptions struct {
+	Format    string         // FormatJSONL or FormatCSV, FormatJSONL if empty
+	BatchSize int            // the number of puts written at once, 1000 if <= 0
+	Progress  func(n uint64) // called with the number of keys imported so far after every batch
+}
+
+// Export writes the live keys of a snapshot of the storage with their values
+// to w in key order, and returns the number of keys written.
+func (storage *Storage) Export(w io.Writer, opts *ExportOptions) (uint64, error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	enc, err := newLineEncoder(w, opts.Format)
+	if err != nil {
+		return 0, err
+	}
+	snap, err := storage.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	it := snap.NewIterator(&IteratorOptions{Prefix: opts.Prefix})
+	defer it.Close()
+	var n uint64
+	for ok := it.First(); ok; ok = it.Next() {
+		value, meta, err := snap.getWithMeta(it.Key())
+		if err == ErrNotFound {
+			// expired since the iterator moved to it
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		line := exportLine{Timestamp: it.e.Timestamp, ExpiresAt: it.e.Expiry, Meta: meta}
+		line.Key, line.Value, line.Encoding = encodeText(it.Key(), value)
+		if err := enc.encode(&line); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, enc.flush()
+}
+
+// Import puts the keys read from r in the format written by Export, with
+// their expiry. Keys which already expired are skipped, timestamps are those
+// of the import. It returns the number of keys imported, the keys of the
+// batches written before an error stay imported.
+func (storage *Storage) Import(r io.Reader, opts *ImportOptions) (uint64, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+	dec, err := newLineDecoder(r, opts.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	b := NewBatch()
+	write := func() error {
+		if b.Len() == 0 {
+			return nil
+		}
+		if err := storage.Write(b); err != nil {
+			return err
+		}
+		n += uint64(b.Len())
+		b = NewBatch()
+		if opts.Progress != nil {
+			opts.Progress(n)
+		}
+		return nil
+	}
+	for {
+		line, err := dec.decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		key, value, err := decodeText(line)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %w", dec.line(), err)
+		}
+		var ttl time.Duration
+		if line.ExpiresAt != 0 {
+			if ttl = time.Until(time.Unix(int64(line.ExpiresAt), 0)); ttl <= 0 {
+				continue
+			}
+		}
+		b.PutWithMeta(key, value, line.Meta, ttl)
+		if b.Len() >= batchSize {
+			if err := write(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, write()
+}
+
+// encodeText returns key and value as text, and their encoding.
+func encodeText(key, value []byte) (string, string, string) {
+	if utf8.Valid(key) && utf8.Valid(value) {
+		return string(key), string(value), ""
+	}
+	return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(value), "base64"
+}
+
+// decodeText returns the key and value of an exported line.
+func decodeText(line *exportLine) ([]byte, []byte, error) {
+	switch line.Encoding {
+	case "":
+		return []byte(line.Key), []byte(line.Value), nil
+	case "base64":
+		key, err := base64.StdEncoding.DecodeString(line.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := base64.StdEncoding.DecodeString(line.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, value, nil
+	}
+	return nil, nil, fmt.Errorf("unknown encoding %q", line.Encoding)
+}
+
+// lineEncoder writes exported lines in a format.
+type lineEncoder struct {
+	w    *bufio.Writer
+	json *json.Encoder
+	csv  *csv.Writer
+}
+
+func newLineEncoder(w io.Writer, format string) (*lineEncoder, error) {
+	enc := &lineEncoder{w: bufio.NewWriter(w)}
+	switch format {
+	case "", FormatJSONL:
+		enc.json = json.NewEncoder(enc.w)
+	case FormatCSV:
+		enc.csv = csv.NewWriter(enc.w)
+		if err := enc.csv.Write(csvHeader); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFormat, format)
+	}
+	return enc, nil
+}
+
+func (enc *lineEncoder) encode(line *exportLine) error {
+	if enc.json != nil {
+		return enc.json.Encode(line)
+	}
+	return enc.csv.Write([]string{
+		line.Key,
+		line.Value,
+		line.Encoding,
+		strconv.FormatUint(uint64(line.Timestamp), 10),
+		strconv.FormatUint(uint64(line.ExpiresAt), 10),
+		strconv.FormatUint(uint64(line.Meta), 10),
+	})
+}
+
+func (enc *lineEncoder) flush() error {
+	if enc.csv != nil {
+		enc.csv.Flush()
+		if err := enc.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return enc.w.Flush()
+}
+
+// lineDecoder reads exported lines in a format.
+type lineDecoder struct {
+	json *json.Decoder
+	csv  *csv.Reader
+	n    int
+}
+
+func newLineDecoder(r io.Reader, format string) (*lineDecoder, error) {
+	dec := &lineDecoder{}
+	switch format {
+	case "", FormatJSONL:
+		dec.json = json.NewDecoder(bufio.NewReader(r))
+	case FormatCSV:
+		dec.csv = csv.NewReader(bufio.NewReader(r))
+		// the lines have as many fields as the header
+		dec.csv.ReuseRecord = true
+		header, err := dec.csv.Read()
+		if err != nil {
+			if err == io.EOF {
+				return dec, nil
+			}
+			return nil, err
+		}
+		if len(header) != len(csvHeader) && len(header) != len(csvHeader)-1 {
+			return nil, fmt.Errorf("line 1: %d fields, want %d", len(header), len(csvHeader))
+		}
+		dec.n++
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrFormat, format)
+	}
+	return dec, nil
+}
+
+// line returns the number of the line decoded last.
+func (dec *lineDecoder) line() int {
+	return dec.n
+}
+
+func (dec *lineDecoder) decode() (*exportLine, error) {
+	line := &exportLine{}
+	dec.n++
+	if dec.json != nil {
+		if err := dec.json.Decode(line); err != nil {
+			if err != io.EOF {
+				err = fmt.Errorf("line %d: %w", dec.n, err)
+			}
+			return nil, err
+		}
+		return line, nil
+	}
+	rec, err := dec.csv.Read()
+	if err != nil {
+		return nil, err
+	}
+	// a quoted field may span lines
+	dec.n, _ = dec.csv.FieldPos(0)
+	line.Key, line.Value, line.Encoding = rec[0], rec[1], rec[2]
+	timestamp, err := parseUint32(rec[3])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: timestamp: %w", dec.n, err)
+	}
+	expiresAt, err := parseUint32(rec[4])
+	if err != nil {
+		return nil, fmt.Errorf("line %d: expires_at: %w", dec.n, err)
+	}
+	line.Timestamp, line.ExpiresAt = timestamp, expiresAt
+	if len(rec) > 5 {
+		if line.Meta, err = parseUint32(rec[5]); err != nil {
+			return nil, fmt.Errorf("line %d: meta: %w", dec.n, err)
+		}
+	}
+	return line, nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(s, 10, 32)
+	return uint32(v), err
+}
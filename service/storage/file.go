@@ -1,22 +1,35 @@
 package storage
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 	"time"
 )
 
 const (
-	HeaderSize    = 16 // 4 + 4 + 4 + 4: crc32 + timestamp + keySize + valueSize
-	IdxHeaderSize = 20 // 4 + 4 + 4 + 8: timestamp + keySize + valueSize + valueOffset
+	HeaderSize    = 24 // 4 + 4 + 4 + 4 + 4 + 4: crc32 + timestamp + keySize + valueSize + flags + expiry
+	IdxHeaderSize = 28 // 4 + 4 + 4 + 8 + 4 + 4: timestamp + keySize + valueSize + valueOffset + flags + expiry
 	BSM           = ".bsm"
 	IDX           = ".idx"
 )
 
+// flags of a data/idx record
+const (
+	flagTombstone  uint32 = 1 << iota // the record deletes its key, the value is empty
+	flagBatchBegin                    // the header of a batch, the key holds the number of records
+	flagBatchEnd                      // the footer of a batch, the key holds the number of records and their crc32
+	flagMeta                          // the value starts with the meta of the record, see withMeta
+)
+
 // BFiles represents a collection of BFile objects.
 type BFiles struct {
 	bfs    map[uint32]*BFile
+	pins   map[uint32]int // number of readers which need the file to stay as it is
 	rwLock *sync.RWMutex
 }
 
@@ -24,6 +37,7 @@ type BFiles struct {
 func newBFiles() *BFiles {
 	return &BFiles{
 		bfs:    make(map[uint32]*BFile),
+		pins:   make(map[uint32]int),
 		rwLock: &sync.RWMutex{},
 	}
 }
@@ -36,11 +50,60 @@ func (bfs *BFiles) get(fileID uint32) *BFile {
 	return bf
 }
 
-// put adds a new BFile object to the collection.
-func (bfs *BFiles) put(bf *BFile, fileID uint32) {
+// put adds a new BFile object to the collection unless one of fileID is in it
+// already, a reader may have opened it meanwhile. It returns the BFile object
+// in the collection and closes the other one.
+func (bfs *BFiles) put(bf *BFile, fileID uint32) *BFile {
 	bfs.rwLock.Lock()
 	defer bfs.rwLock.Unlock()
+	if cur, ok := bfs.bfs[fileID]; ok {
+		bf.close()
+		return cur
+	}
 	bfs.bfs[fileID] = bf
+	return bf
+}
+
+// del closes and removes the BFile object of fileID from the collection.
+func (bfs *BFiles) del(fileID uint32) {
+	bfs.rwLock.Lock()
+	defer bfs.rwLock.Unlock()
+	if bf, ok := bfs.bfs[fileID]; ok {
+		bf.close()
+		delete(bfs.bfs, fileID)
+	}
+}
+
+// pin keeps the files from being merged until they are unpinned.
+func (bfs *BFiles) pin(fileIDs ...uint32) {
+	bfs.rwLock.Lock()
+	defer bfs.rwLock.Unlock()
+	for _, id := range fileIDs {
+		bfs.pins[id]++
+	}
+}
+
+// unpin releases the files pinned by pin.
+func (bfs *BFiles) unpin(fileIDs ...uint32) {
+	bfs.rwLock.Lock()
+	defer bfs.rwLock.Unlock()
+	for _, id := range fileIDs {
+		if bfs.pins[id]--; bfs.pins[id] <= 0 {
+			delete(bfs.pins, id)
+		}
+	}
+}
+
+// pinned returns whether any of the files is pinned.
+func (bfs *BFiles) pinned(fileIDs ...uint32) bool {
+	bfs.rwLock.RLock()
+	defer bfs.rwLock.RUnlock()
+	for _, id := range fileIDs {
+		if bfs.pins[id] > 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // close closes all BFile objects in the collection.
@@ -48,17 +111,32 @@ func (bfs *BFiles) close() {
 	bfs.rwLock.Lock()
 	defer bfs.rwLock.Unlock()
 	for _, bf := range bfs.bfs {
-		bf.fp.Close()
+		bf.close()
+	}
+}
+
+// close unmaps and closes the files of a BFile object kept by BFiles.
+func (bf *BFile) close() {
+	bf.munmapFile()
+	bf.fp.Close()
+	if bf.idxFp != nil {
 		bf.idxFp.Close()
 	}
 }
 
 // BFile represents a writable data file and its associated idx file.
+// The records appended to the writeable file are buffered until the writer
+// flushes them, the buffer is read like the rest of the file meanwhile.
 type BFile struct {
 	fp          *os.File
 	fileID      uint32
-	writeOffset uint64
+	writeOffset uint64 // end of the data file, buffered records included
+	flushOffset uint64 // end of the data written to the file, where buf starts
+	buf         []byte // buffered data records
 	idxFp       *os.File
+	idxOffset   int64  // end of the idx file, idxBuf excluded
+	idxBuf      []byte // buffered idx records
+	mmap        []byte // the mapped immutable data file, nil if it is read with ReadAt
 }
 
 // openBFile opens an existing BFile object by dirName and tStamp.
@@ -68,7 +146,7 @@ func newBFile() *BFile {
 
 func openBFile(dirName string, tStamp int) (*BFile, error) {
 	filename := fmt.Sprintf("%s/%d%s", dirName, tStamp, BSM)
-	fp, err := os.OpenFile(filename, os.O_RDONLY|os.O_SYNC, 0600)
+	fp, err := os.OpenFile(filename, os.O_RDONLY, 0600)
 	if err != nil {
 		return nil, err
 	}
@@ -83,83 +161,206 @@ func openBFile(dirName string, tStamp int) (*BFile, error) {
 // read reads the value associated with a given offset and length.
 func (bf *BFile) read(offset uint64, length uint32) ([]byte, error) {
 	value := make([]byte, length)
-	//TODO
-	// assert read function and crc32
-	if _, err := bf.fp.ReadAt(value, int64(offset)); err != nil {
+	if err := bf.readAt(value, offset); err != nil {
 		return nil, err
 	}
 	return value, nil
 }
 
-// writeData writes a key-value pair to the BFile object.
-func (bf *BFile) writeDatat(key []byte, value []byte) (entry, error) {
-	// 1. write into datafile
-	timeStamp := uint32(time.Now().Unix())
-	keySize := uint32(len(key))
-	valueSize := uint32(len(value))
-	vec := encodeEntry(timeStamp, keySize, valueSize, key, value)
-	entrySize := HeaderSize + keySize + valueSize
-
-	valueOffset := bf.writeOffset + uint64(HeaderSize+keySize)
-	// write data file into disk
-	// TODO
-	// assert WriteAt function
-	_, err := appendWriteFile(bf.fp, vec)
-	if err != nil {
-		panic(err)
+// readAt reads len(p) bytes at offset, from the buffer if they are not
+// flushed yet. A record is never split between the file and the buffer.
+func (bf *BFile) readAt(p []byte, offset uint64) error {
+	// a file appended by the writer of a read only storage may grow past its mapping
+	if bf.mmap != nil && offset+uint64(len(p)) <= uint64(len(bf.mmap)) {
+		copy(p, bf.mmap[offset:])
+		return nil
+	}
+	if len(bf.buf) == 0 || offset < bf.flushOffset {
+		_, err := bf.fp.ReadAt(p, int64(offset))
+		return err
+	}
+	start := offset - bf.flushOffset
+	if start+uint64(len(p)) > uint64(len(bf.buf)) {
+		return io.ErrUnexpectedEOF
 	}
-	//logger.Debug("has write into data file:", n)
+	copy(p, bf.buf[start:])
+	return nil
+}
 
-	// 2. write idx file disk
-	idxData := EncodeIdx(timeStamp, keySize, valueSize, valueOffset, key)
-	// TODO
-	// assert write function
-	_, err = appendWriteFile(bf.idxFp, idxData)
+// readChecked reads the whole record of the value at offset and verifies its crc32,
+// the error wraps ErrCrc32 with the position of the record if it doesn't match.
+func (bf *BFile) readChecked(keySize uint32, offset uint64, length uint32) ([]byte, error) {
+	start := offset - uint64(HeaderSize+keySize)
+	buf := make([]byte, HeaderSize+keySize+length)
+	if err := bf.readAt(buf, start); err != nil {
+		return nil, err
+	}
+	value, err := DecodeEntry(buf)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: file id %d, offset %d", err, bf.fileID, start)
 	}
-	//logger.Debug("has write into idx file:", n)
-	bf.writeOffset += uint64(entrySize)
+	return value, nil
+}
 
-	return entry{
-		FileID:      bf.fileID,
-		ValueSize:   valueSize,
-		ValueOffset: valueOffset,
-		Timestamp:   timeStamp,
-	}, nil
+// writeData writes a key-value pair expiring at the unix time expiry to the BFile object,
+// an expiry of 0 never expires. flags tell how the value is encoded.
+func (bf *BFile) writeDatat(key []byte, value []byte, flags, expiry uint32) (entry, error) {
+	return bf.writeRecord(key, value, flags, expiry)
+}
+
+// del writes a tombstone of the key to the BFile object, flags must include flagTombstone.
+func (bf *BFile) del(key []byte, flags uint32) error {
+	_, err := bf.writeRecord(key, nil, flags, 0)
+	return err
 }
 
-func (bf *BFile) del(key []byte) error {
-	// 1. write into datafile
+// record is a record to append to a BFile.
+type record struct {
+	key    []byte
+	value  []byte
+	flags  uint32
+	expiry uint32
+}
+
+// writeRecord appends a record to the data file and its idx file.
+func (bf *BFile) writeRecord(key []byte, value []byte, flags, expiry uint32) (entry, error) {
 	timeStamp := uint32(time.Now().Unix())
-	keySize := uint32(0)
-	valueSize := uint32(0)
-	vec := encodeEntry(timeStamp, keySize, valueSize, key, nil)
-	//logger.Info(len(vec), keySize, valueSize)
-	entrySize := HeaderSize + keySize + valueSize
-	// TODO
-	// race data
-	valueOffset := bf.writeOffset + uint64(HeaderSize+keySize)
-	// write data file into disk
-	// TODO
-	// assert WriteAt function
-	_, err := appendWriteFile(bf.fp, vec)
-	if err != nil {
-		panic(err)
+	data, idxData, entries := bf.encodeRecords(timeStamp, bf.writeOffset, []record{{key, value, flags, expiry}})
+	if err := bf.appendRecords(data, idxData); err != nil {
+		return entry{}, err
 	}
+	return entries[0], nil
+}
 
-	//logger.Debug("has write into data file:", n)
-	// 2. write idx file disk
-	idxData := EncodeIdx(timeStamp, keySize, valueSize, valueOffset, key)
+// writeBatch appends the records framed by a batch header and footer, so they
+// are replayed all together or not at all. The header holds the number of
+// records and the footer holds it again with the crc32 of the framed records.
+func (bf *BFile) writeBatch(recs []record) ([]entry, error) {
+	timeStamp := uint32(time.Now().Unix())
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, uint32(len(recs)))
 
-	// TODO
-	// assert write function
-	_, err = appendWriteFile(bf.idxFp, idxData)
-	if err != nil {
-		panic(err)
+	headerOffset := bf.writeOffset
+	header, headerIdx, _ := bf.encodeRecords(timeStamp, headerOffset, []record{{key: count, flags: flagBatchBegin}})
+	bodyOffset := headerOffset + uint64(len(header))
+	body, bodyIdx, entries := bf.encodeRecords(timeStamp, bodyOffset, recs)
+
+	footerKey := make([]byte, 8)
+	copy(footerKey, count)
+	binary.LittleEndian.PutUint32(footerKey[4:], crc32.ChecksumIEEE(body))
+	footer, footerIdx, _ := bf.encodeRecords(timeStamp, bodyOffset+uint64(len(body)), []record{{key: footerKey, flags: flagBatchEnd}})
+
+	data := append(append(header, body...), footer...)
+	idxData := append(append(headerIdx, bodyIdx...), footerIdx...)
+	if err := bf.appendRecords(data, idxData); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// encodeRecords encodes the records as if they are appended at offset of the
+// data file, and returns the data and idx bytes with the entries of the records.
+func (bf *BFile) encodeRecords(timeStamp uint32, offset uint64, recs []record) ([]byte, []byte, []entry) {
+	var data, idxData []byte
+	entries := make([]entry, 0, len(recs))
+	for _, rec := range recs {
+		keySize := uint32(len(rec.key))
+		valueSize := uint32(len(rec.value))
+		valueOffset := offset + uint64(len(data)) + uint64(HeaderSize+keySize)
+		data = append(data, encodeEntry(timeStamp, keySize, valueSize, rec.flags, rec.expiry, rec.key, rec.value)...)
+		idxData = append(idxData, EncodeIdx(timeStamp, keySize, valueSize, valueOffset, rec.flags, rec.expiry, rec.key)...)
+		entries = append(entries, entry{
+			FileID:      bf.fileID,
+			KeySize:     keySize,
+			ValueSize:   valueSize,
+			ValueOffset: valueOffset,
+			Timestamp:   timeStamp,
+			Expiry:      rec.expiry,
+			Flags:       rec.flags,
+		})
+	}
+	return data, idxData, entries
+}
+
+// appendRecords buffers the encoded records and their idx records until the
+// next flush.
+func (bf *BFile) appendRecords(data, idxData []byte) error {
+	bf.buf = append(bf.buf, data...)
+	bf.idxBuf = append(bf.idxBuf, idxData...)
+	bf.writeOffset += uint64(len(data))
+	return nil
+}
+
+// writeBuffered writes the buffered records into the data file, then their
+// idx records into the idx file. It leaves the buffers as they are, so the
+// readers can go on reading them without a lock.
+func (bf *BFile) writeBuffered() error {
+	if _, err := bf.fp.WriteAt(bf.buf, int64(bf.flushOffset)); err != nil {
+		return err
 	}
-	//logger.Debug("has write into idx file:", n)
-	bf.writeOffset += uint64(entrySize)
+	if _, err := bf.idxFp.WriteAt(bf.idxBuf, bf.idxOffset); err != nil {
+		return err
+	}
+	return nil
+}
+
+// dropBuffered empties the buffers written by writeBuffered, the caller must
+// keep the readers out.
+func (bf *BFile) dropBuffered() {
+	bf.flushOffset += uint64(len(bf.buf))
+	bf.idxOffset += int64(len(bf.idxBuf))
+	bf.buf = bf.buf[:0]
+	bf.idxBuf = bf.idxBuf[:0]
+}
 
+// flush writes out the buffered records, the caller must keep the readers out.
+func (bf *BFile) flush() error {
+	if err := bf.writeBuffered(); err != nil {
+		return err
+	}
+	bf.dropBuffered()
 	return nil
 }
+
+// idxRecord represents a decoded record of an idx file.
+type idxRecord struct {
+	Timestamp   uint32
+	KeySize     uint32
+	ValueSize   uint32
+	ValueOffset uint64
+	Flags       uint32
+	Expiry      uint32
+	Key         []byte
+}
+
+// walkIdx reads the idx file from the beginning and calls fn for every record.
+// It returns io.ErrUnexpectedEOF if the file ends with a partial record.
+func walkIdx(fp *os.File, fn func(rec *idxRecord) error) error {
+	return walkIdxAt(fp, 0, fn)
+}
+
+// walkIdxAt is walkIdx starting at offset of the idx file.
+func walkIdxAt(fp *os.File, offset int64, fn func(rec *idxRecord) error) error {
+	r := bufio.NewReader(io.NewSectionReader(fp, offset, 1<<62))
+	header := make([]byte, IdxHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		rec := &idxRecord{}
+		rec.Timestamp, rec.KeySize, rec.ValueSize, rec.ValueOffset, rec.Flags, rec.Expiry = DecodeIdx(header)
+		rec.Key = make([]byte, rec.KeySize)
+		if _, err := io.ReadFull(r, rec.Key); err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
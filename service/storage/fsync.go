@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// sync modes of the writes
+const (
+	SyncAlways   = "always"   // a write returns once it is on disk, the writes flushed together share an fsync
+	SyncInterval = "interval" // the writeable file is synced every Config.FsyncIntervalMs
+	SyncNone     = "none"     // the OS decides when the writes reach the disk
+)
+
+// syncWriteable syncs the writes flushed so far and marks them as synced.
+// Only the data file is synced, a record missing from the idx file is added
+// back from the data file when the storage is opened.
+func (storage *Storage) syncWriteable() error {
+	storage.rwLock.RLock()
+	fp := storage.writeFile.fp
+	target := storage.flushed
+	storage.rwLock.RUnlock()
+
+	storage.syncLock.Lock()
+	done := target <= storage.synced
+	storage.syncLock.Unlock()
+	if done {
+		return nil
+	}
+	// a file closed meanwhile was synced before it was closed
+	if err := fp.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	atomic.AddUint64(&storage.stats.Syncs, 1)
+	storage.syncLock.Lock()
+	if target > storage.synced {
+		storage.synced = target
+	}
+	storage.syncLock.Unlock()
+	return nil
+}
+
+// syncLoop syncs the writeable file every Config.FsyncIntervalMs until the
+// storage is closed. A Config not validated may leave the interval unset, the
+// default interval is used then.
+func (storage *Storage) syncLoop() {
+	defer storage.wg.Done()
+	interval := storage.Config.FsyncIntervalMs
+	if interval <= 0 {
+		interval = defaultFsyncIntervalMs
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := storage.syncWriteable(); err != nil {
+				storage.fail(err)
+			}
+		case <-storage.closing:
+			return
+		}
+	}
+}
+
+// syncDir syncs the entries of dir, so the files created or renamed in it
+// survive a crash. Windows can't sync a directory, a rename is durable there
+// once the file is.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fp.Sync()
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
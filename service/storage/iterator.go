@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"time"
+)
+
+// IteratorOptions bounds the keys visited by an Iterator.
+type IteratorOptions struct {
+	Prefix []byte // only visit keys starting with Prefix
+	Start  []byte // inclusive lower bound, nil is unbounded
+	End    []byte // exclusive upper bound, nil is unbounded
+}
+
+// Iterator visits the live keys of a Storage in key order. Every move looks
+// the key up in the current keydir, so the iterator sees the writes made
+// while it is open, unless it belongs to a Snapshot. An Iterator is not safe
+// for concurrent use.
+type Iterator struct {
+	storage *Storage
+	snap    *Snapshot // the snapshot iterated over, nil for the current keydir
+	lower   string    // inclusive
+	upper   string    // exclusive
+	bounded bool      // whether upper is set
+
+	key   string
+	e     *entry
+	valid bool
+}
+
+// NewIterator returns an Iterator over the keys within opts, it is positioned
+// before the first key: call First, Last or Seek to start.
+func (storage *Storage) NewIterator(opts *IteratorOptions) *Iterator {
+	it := &Iterator{storage: storage}
+	if opts == nil {
+		return it
+	}
+	lower, upper := opts.Start, opts.End
+	if opts.Prefix != nil {
+		if bytes.Compare(opts.Prefix, lower) > 0 {
+			lower = opts.Prefix
+		}
+		if end := prefixEnd(opts.Prefix); end != nil && (upper == nil || bytes.Compare(end, upper) < 0) {
+			upper = end
+		}
+	}
+	it.lower = string(lower)
+	if upper != nil {
+		it.upper, it.bounded = string(upper), true
+	}
+	return it
+}
+
+// prefixEnd returns the smallest key greater than all keys with prefix,
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// First moves to the first key, it returns false if there is none.
+func (it *Iterator) First() bool {
+	v := it.view()
+	return it.forward(v, viewCeiling(v, it.lower, false))
+}
+
+// Last moves to the last key, it returns false if there is none.
+func (it *Iterator) Last() bool {
+	v := it.view()
+	if it.bounded {
+		return it.backward(v, viewFloor(v, it.upper, true))
+	}
+	return it.backward(v, viewLast(v))
+}
+
+// Seek moves to the first key >= key, it returns false if there is none.
+func (it *Iterator) Seek(key []byte) bool {
+	k := string(key)
+	if k < it.lower {
+		k = it.lower
+	}
+	v := it.view()
+	return it.forward(v, viewCeiling(v, k, false))
+}
+
+// Next moves to the next key, it returns false if there is none.
+func (it *Iterator) Next() bool {
+	if !it.valid {
+		return false
+	}
+	v := it.view()
+	return it.forward(v, viewCeiling(v, it.key, true))
+}
+
+// Prev moves to the previous key, it returns false if there is none.
+func (it *Iterator) Prev() bool {
+	if !it.valid {
+		return false
+	}
+	v := it.view()
+	return it.backward(v, viewFloor(v, it.key, true))
+}
+
+// view returns the keydir to look keys up in.
+func (it *Iterator) view() *keydirView {
+	if it.snap != nil {
+		return &it.snap.view
+	}
+	v := it.storage.entryCache.Root()
+	return &v
+}
+
+// forward settles on n or the first following node which is not expired.
+func (it *Iterator) forward(v *keydirView, n *node) bool {
+	now := time.Now()
+	for n != nil && n.e.IsExpired(now) && it.inBounds(n.key) {
+		n = viewCeiling(v, n.key, true)
+	}
+	return it.settle(n)
+}
+
+// backward settles on n or the first preceding node which is not expired.
+func (it *Iterator) backward(v *keydirView, n *node) bool {
+	now := time.Now()
+	for n != nil && n.e.IsExpired(now) && it.inBounds(n.key) {
+		n = viewFloor(v, n.key, true)
+	}
+	return it.settle(n)
+}
+
+func (it *Iterator) inBounds(key string) bool {
+	return key >= it.lower && (!it.bounded || key < it.upper)
+}
+
+func (it *Iterator) settle(n *node) bool {
+	if n == nil || !it.inBounds(n.key) || n.e.IsExpired(time.Now()) {
+		it.key, it.e, it.valid = "", nil, false
+		return false
+	}
+	it.key, it.e, it.valid = n.key, &n.e, true
+	return true
+}
+
+// Valid returns whether the iterator is positioned at a key.
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return []byte(it.key)
+}
+
+// Value returns the current value of the current key, ErrNotFound if the key
+// has been deleted since the iterator moved to it.
+func (it *Iterator) Value() ([]byte, error) {
+	if !it.valid {
+		return nil, ErrNotFound
+	}
+	if it.snap != nil {
+		return it.snap.Get([]byte(it.key))
+	}
+	return it.storage.Get([]byte(it.key))
+}
+
+// Close releases the iterator.
+func (it *Iterator) Close() error {
+	it.key, it.e, it.valid = "", nil, false
+	return nil
+}
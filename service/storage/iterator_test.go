@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"unsafe"
+
+	"mousedb/pkg/assert"
+)
+
+func TestEntryCacheOrder(t *testing.T) {
+	k := NewEntryCache()
+	keys := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("%d", rand.Intn(500))
+		if rand.Intn(3) == 0 {
+			k.Del(key)
+			delete(keys, key)
+			continue
+		}
+		k.Put(key, &entry{})
+		keys[key] = true
+	}
+
+	want := make([]string, 0, len(keys))
+	for key := range keys {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	got := make([]string, 0, len(keys))
+	v := k.Root()
+	for n := viewCeiling(&v, "", false); n != nil; n = viewCeiling(&v, n.key, true) {
+		got = append(got, n.key)
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, len(want), k.Len())
+}
+
+func TestEntryCacheShards(t *testing.T) {
+	k := NewEntryCache()
+	keys := make([]string, 100)
+	es := make([]*entry, len(keys))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%03d", i)
+		es[i] = &entry{FileID: 1}
+	}
+
+	// a view has all the keys of a batch or none of them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			v := k.Root()
+			n := 0
+			for _, key := range keys {
+				if viewGet(&v, key) != nil {
+					n++
+				}
+			}
+			assert.T(t, n == 0 || n == len(keys))
+		}
+	}()
+	k.Apply(keys, es)
+	<-done
+
+	m := k.memory()
+	assert.Equal(t, uint64(len(keys)), m.keys)
+	assert.Equal(t, uint64(len(keys)*len("key-000")), m.keyBytes)
+	assert.T(t, m.arenaBytes >= keyChunkSize)
+	assert.Equal(t, uint64(len(keys))*uint64(unsafe.Sizeof(node{})), m.nodeBytes)
+
+	// rewriting a key keeps its key bytes
+	k.Put("key-000", &entry{FileID: 2})
+	assert.Equal(t, uint32(2), k.Get("key-000").FileID)
+	k.Del("key-001")
+	m = k.memory()
+	assert.Equal(t, uint64(len(keys)-1), m.keys)
+	assert.Equal(t, uint64((len(keys)-1)*len("key-000")), m.keyBytes)
+}
+
+func TestIterator(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+	for _, key := range []string{"user:1:a", "user:1:b", "user:12:a", "user:123:a", "user:123:b", "user:2:a", "zzz"} {
+		assert.Nil(t, s.Put([]byte(key), []byte("v-"+key)))
+	}
+
+	keys := func(it *Iterator, ok bool) []string {
+		var keys []string
+		for ; ok; ok = it.Next() {
+			keys = append(keys, string(it.Key()))
+		}
+		return keys
+	}
+
+	it := s.NewIterator(&IteratorOptions{Prefix: []byte("user:123:")})
+	assert.Equal(t, []string{"user:123:a", "user:123:b"}, keys(it, it.First()))
+	value, err := func() ([]byte, error) { it.Last(); return it.Value() }()
+	assert.Nil(t, err)
+	assert.Equal(t, "v-user:123:b", string(value))
+	assert.T(t, it.Prev())
+	assert.Equal(t, "user:123:a", string(it.Key()))
+	assert.T(t, !it.Prev())
+
+	it = s.NewIterator(&IteratorOptions{Start: []byte("user:123:b"), End: []byte("user:1:")})
+	assert.Equal(t, []string{"user:123:b", "user:12:a"}, keys(it, it.First()))
+
+	it = s.NewIterator(nil)
+	assert.Equal(t, []string{"user:2:a", "zzz"}, keys(it, it.Seek([]byte("user:2"))))
+
+	// the iterator sees the writes made while it is open
+	it = s.NewIterator(&IteratorOptions{Prefix: []byte("user:1:")})
+	assert.T(t, it.First())
+	assert.Nil(t, s.Del([]byte("user:1:b")))
+	assert.Nil(t, s.Put([]byte("user:1:c"), []byte("c")))
+	assert.T(t, it.Next())
+	assert.Equal(t, "user:1:c", string(it.Key()))
+	assert.T(t, !it.Next())
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrLocked is returned by Open when another process holds the lock of the directory.
+var ErrLocked = fmt.Errorf("storage is locked")
+
+// errLockHeld is returned by flock when the lock is taken.
+var errLockHeld = errors.New("lock is held")
+
+// errLockUnsupported is returned by flock on the platforms without a file lock.
+var errLockUnsupported = errors.New("file lock is not supported on this platform")
+
+// the wait between two attempts to take the lock
+const lockRetryInterval = 100 * time.Millisecond
+
+// lockDir takes the lock of the directory, waiting up to timeout for the
+// process holding it to go away. The error wraps ErrLocked with the PID of
+// the holder if it is still held after timeout. A lock file left by a crashed
+// process doesn't hold the lock, it is taken over. On the platforms without a
+// file lock the directory is opened with a warning, nothing keeps another
+// writer out.
+func (storage *Storage) lockDir(fileName string, timeout time.Duration) (*os.File, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fp, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = flock(fp)
+		if err == errLockUnsupported {
+			storage.Logger.Warn("the directory can't be locked on this platform, another writer opening it corrupts it",
+				zap.String("file", fileName))
+			err = nil
+		}
+		if err == nil {
+			if pid := readPID(fp); pid > 0 && pid != os.Getpid() && !processAlive(pid) {
+				storage.Logger.Warn("clear the stale lock of a stopped process", zap.Int("pid", pid))
+			}
+			return fp, nil
+		}
+		pid := readPID(fp)
+		fp.Close()
+		if err != errLockHeld {
+			return nil, err
+		}
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("%w by pid %d: %s", ErrLocked, pid, fileName)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// readPID returns the PID written into the lock file by writePID, 0 if there is none.
+func readPID(fp *os.File) int {
+	buf := make([]byte, 64)
+	n, err := fp.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0
+	}
+	text := string(buf[:n])
+	if i := strings.IndexByte(text, '\t'); i >= 0 {
+		text = text[:i]
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(text))
+	return pid
+}
@@ -0,0 +1,21 @@
+//go:build !unix && !windows
+
+package storage
+
+import "os"
+
+// flock is not supported, it returns errLockUnsupported and the lock file only
+// records the PID of the writer.
+func flock(fp *os.File) error {
+	return errLockUnsupported
+}
+
+// processAlive returns whether the process pid is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
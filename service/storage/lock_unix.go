@@ -0,0 +1,26 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// flock takes the advisory lock of fp without blocking, it returns
+// errLockHeld if another process holds it. The lock goes away with the
+// process holding it.
+func flock(fp *os.File) error {
+	err := unix.Flock(int(fp.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == unix.EWOULDBLOCK {
+		return errLockHeld
+	}
+	return err
+}
+
+// processAlive returns whether the process pid is running.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
@@ -0,0 +1,425 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	mergeSuffix       = ".merge"         // suffix of the data/idx files written by a running merge
+	mergeManifestName = "merge.manifest" // the file operations to put a finished merge in place
+)
+
+// mergeFile is a data/idx pair written by merge under a temporary name.
+type mergeFile struct {
+	fp     *os.File
+	idxFp  *os.File
+	w      *bufio.Writer
+	idxW   *bufio.Writer
+	offset uint64
+}
+
+// mergedEntry remembers a record copied by merge, so the EntryCache can be
+// pointed at the new location once the merged files are in place.
+type mergedEntry struct {
+	key         string
+	old         entry
+	out         int
+	valueOffset uint64
+	keySize     uint32
+	valueSize   uint32
+	flags       uint32
+}
+
+// merger rewrites a set of immutable data files.
+type merger struct {
+	storage  *Storage
+	ids      []uint32 // sorted ids of the files being merged
+	outs     []*mergeFile
+	entries  []mergedEntry
+	expired  []mergedEntry // dropped expired records, to remove from the EntryCache
+	inSize   uint64
+	outSize  uint64
+	resealed int // records encrypted again with the current key
+}
+
+// mergeLoop runs Merge every Config.MergeSecs until the storage is closed.
+func (storage *Storage) mergeLoop() {
+	defer storage.wg.Done()
+	ticker := time.NewTicker(time.Duration(storage.Config.MergeSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := storage.Merge(); err != nil {
+				storage.Logger.Error("merge data files failed", zap.Error(err))
+			}
+		case <-storage.closing:
+			return
+		}
+	}
+}
+
+// Merge rewrites all immutable data files into new files holding only the
+// records still referenced by the EntryCache, then deletes the old files.
+// The writeable file is never merged.
+func (storage *Storage) Merge() error {
+	if !storage.Config.ReadWrite {
+		return ErrReadOnly
+	}
+	storage.mergeLock.Lock()
+	defer storage.mergeLock.Unlock()
+
+	storage.rwLock.RLock()
+	activeID := storage.writeFile.fileID
+	storage.rwLock.RUnlock()
+
+	ids, err := immutableFileIDs(storage, activeID)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	if storage.oldFile.pinned(ids...) {
+		storage.Logger.Info("merge postponed, data files are pinned by a snapshot")
+		return nil
+	}
+
+	m := &merger{storage: storage, ids: ids}
+	if err := m.copyLive(); err != nil {
+		m.abort()
+		return err
+	}
+	if err := m.flush(); err != nil {
+		m.abort()
+		return err
+	}
+	// nothing to reclaim
+	if m.outSize == m.inSize && len(m.outs) == len(m.ids) && m.resealed == 0 {
+		m.abort()
+		return nil
+	}
+	swapped, err := m.swap()
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		m.abort()
+		storage.Logger.Info("merge postponed, data files are pinned by a snapshot")
+		return nil
+	}
+	storage.Logger.Info("merge data files finished",
+		zap.Int("files", len(m.ids)),
+		zap.Int("merged_files", len(m.outs)),
+		zap.Int64("reclaimed_bytes", int64(m.inSize)-int64(m.outSize)),
+		zap.Int("resealed_records", m.resealed))
+	return nil
+}
+
+// copyLive copies every record of the merged files which the EntryCache
+// still points at into the merge output files. Tombstones are dropped, every
+// file older than the writeable file takes part in the merge, so no older
+// record of a deleted key survives it. Expired records are dropped as well.
+// The records not encrypted by the current key are encrypted again.
+func (m *merger) copyLive() error {
+	dir := m.storage.dirFile
+	now := time.Now()
+	for _, id := range m.ids {
+		dataFp, err := os.Open(fmt.Sprintf("%s/%d%s", dir, id, BSM))
+		if err != nil {
+			return err
+		}
+		idxFp, err := os.Open(fmt.Sprintf("%s/%d%s", dir, id, IDX))
+		if err != nil {
+			dataFp.Close()
+			return err
+		}
+		if stat, err := dataFp.Stat(); err == nil {
+			m.inSize += uint64(stat.Size())
+		}
+
+		err = walkIdx(idxFp, func(rec *idxRecord) error {
+			key, err := m.storage.keys.open(rec.Flags, rec.Key, nil)
+			if err != nil {
+				return err
+			}
+			e := entry{
+				FileID:      id,
+				KeySize:     rec.KeySize,
+				ValueSize:   rec.ValueSize,
+				ValueOffset: rec.ValueOffset,
+				Timestamp:   rec.Timestamp,
+				Expiry:      rec.Expiry,
+				Flags:       rec.Flags,
+			}
+			live := m.storage.entryCache.Get(string(key))
+			if live == nil || !live.IsEqualTo(&e) {
+				return nil
+			}
+			e.Version = live.Version
+			if e.IsExpired(now) {
+				m.expired = append(m.expired, mergedEntry{key: string(key), old: e})
+				return nil
+			}
+			return m.copyRecord(dataFp, rec, key, e)
+		})
+		dataFp.Close()
+		idxFp.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyRecord appends the raw record (crc included) of key to the current
+// output file, a record not encrypted by the current key is encrypted again.
+func (m *merger) copyRecord(dataFp *os.File, rec *idxRecord, key []byte, e entry) error {
+	out, err := m.output()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, HeaderSize+rec.KeySize+rec.ValueSize)
+	if _, err := dataFp.ReadAt(buf, int64(rec.ValueOffset)-int64(HeaderSize+rec.KeySize)); err != nil {
+		return err
+	}
+	keySize, valueSize, flags := rec.KeySize, rec.ValueSize, rec.Flags
+	if m.storage.keys.stale(rec.Flags) {
+		if buf, err = m.storage.reseal(buf, key); err != nil {
+			return err
+		}
+		_, _, keySize, valueSize, flags, _ = DecodeEntryHeader(buf)
+		m.resealed++
+	}
+	if _, err := out.w.Write(buf); err != nil {
+		return err
+	}
+	valueOffset := out.offset + uint64(HeaderSize+keySize)
+	idxData := EncodeIdx(rec.Timestamp, keySize, valueSize, valueOffset, flags, rec.Expiry, buf[HeaderSize:HeaderSize+keySize])
+	if _, err := out.idxW.Write(idxData); err != nil {
+		return err
+	}
+	out.offset += uint64(len(buf))
+	m.outSize += uint64(len(buf))
+	m.entries = append(m.entries, mergedEntry{
+		key:         string(key),
+		old:         e,
+		out:         len(m.outs) - 1,
+		valueOffset: valueOffset,
+		keySize:     keySize,
+		valueSize:   valueSize,
+		flags:       flags,
+	})
+	return nil
+}
+
+// output returns the output file to append to, it starts a new one when the
+// current file is full. There are never more outputs than merged files, since
+// the outputs take over the ids of the merged files.
+func (m *merger) output() (*mergeFile, error) {
+	if n := len(m.outs); n > 0 {
+		out := m.outs[n-1]
+		if out.offset < m.storage.Config.MaxFileSize || n == len(m.ids) {
+			return out, nil
+		}
+	}
+
+	name := m.tmpName(len(m.outs))
+	fp, err := os.OpenFile(name+BSM+mergeSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+	idxFp, err := os.OpenFile(name+IDX+mergeSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	out := &mergeFile{
+		fp:    fp,
+		idxFp: idxFp,
+		w:     bufio.NewWriter(fp),
+		idxW:  bufio.NewWriter(idxFp),
+	}
+	m.outs = append(m.outs, out)
+	return out, nil
+}
+
+func (m *merger) tmpName(n int) string {
+	return m.storage.dirFile + "/" + strconv.Itoa(n)
+}
+
+// flush writes the buffered output to disk and syncs it.
+func (m *merger) flush() error {
+	for _, out := range m.outs {
+		if err := out.w.Flush(); err != nil {
+			return err
+		}
+		if err := out.idxW.Flush(); err != nil {
+			return err
+		}
+		if err := out.fp.Sync(); err != nil {
+			return err
+		}
+		if err := out.idxFp.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort closes and deletes the output files.
+func (m *merger) abort() {
+	for i, out := range m.outs {
+		out.fp.Close()
+		out.idxFp.Close()
+		os.Remove(m.tmpName(i) + BSM + mergeSuffix)
+		os.Remove(m.tmpName(i) + IDX + mergeSuffix)
+	}
+	m.outs = nil
+}
+
+// swap moves the output files in place of the merged files and points the
+// EntryCache at the copied records. The outputs take over the highest ids
+// of the merged files, so replaying the files in id order still lets the
+// newer files win over older ones. It returns false without changing
+// anything if a snapshot taken during the merge pins the merged files.
+func (m *merger) swap() (bool, error) {
+	storage := m.storage
+	storage.rwLock.Lock()
+	defer storage.rwLock.Unlock()
+	if storage.oldFile.pinned(m.ids...) {
+		return false, nil
+	}
+
+	for _, out := range m.outs {
+		out.fp.Close()
+		out.idxFp.Close()
+	}
+	for _, id := range m.ids {
+		storage.oldFile.del(id)
+	}
+
+	// the manifest makes the swap complete on the next Open if we crash half way,
+	// otherwise the dropped tombstones could let deleted keys come back
+	var manifest bytes.Buffer
+	base := len(m.ids) - len(m.outs)
+	for j := range m.outs {
+		fmt.Fprintf(&manifest, "rename %d %d\n", j, m.ids[base+j])
+	}
+	for _, id := range m.ids[:base] {
+		fmt.Fprintf(&manifest, "remove %d\n", id)
+	}
+	if err := writeMergeManifest(storage.dirFile, manifest.Bytes()); err != nil {
+		return false, err
+	}
+	if err := replayMergeManifest(storage.dirFile); err != nil {
+		return false, err
+	}
+
+	for i := range m.entries {
+		me := &m.entries[i]
+		e := &entry{
+			FileID:      m.ids[base+me.out],
+			KeySize:     me.keySize,
+			ValueSize:   me.valueSize,
+			ValueOffset: me.valueOffset,
+			Timestamp:   me.old.Timestamp,
+			Expiry:      me.old.Expiry,
+			Version:     me.old.Version,
+			Flags:       me.flags,
+		}
+		storage.entryCache.SetCompare(me.key, &me.old, e)
+	}
+	for i := range m.expired {
+		storage.entryCache.DelCompare(m.expired[i].key, &m.expired[i].old)
+	}
+	return true, nil
+}
+
+// writeMergeManifest durably writes the manifest of a finished merge.
+func writeMergeManifest(dir string, manifest []byte) error {
+	tmpName := dir + "/" + mergeManifestName + mergeSuffix
+	fp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(manifest); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, dir+"/"+mergeManifestName)
+}
+
+// replayMergeManifest applies the operations of the merge manifest, if any,
+// and deletes it. Every operation can be applied again, so it is safe to
+// replay a manifest which was partially applied before a crash.
+func replayMergeManifest(dir string) error {
+	manifest, err := os.ReadFile(dir + "/" + mergeManifestName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(manifest), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) == 3 && fields[0] == "rename":
+			for _, suffix := range []string{BSM, IDX} {
+				src := dir + "/" + fields[1] + suffix + mergeSuffix
+				if _, err := os.Stat(src); os.IsNotExist(err) {
+					continue
+				}
+				if err := os.Rename(src, dir+"/"+fields[2]+suffix); err != nil {
+					return err
+				}
+			}
+		case len(fields) == 2 && fields[0] == "remove":
+			for _, suffix := range []string{BSM, IDX} {
+				if err := os.Remove(dir + "/" + fields[1] + suffix); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("invalid merge manifest line: %q", line)
+		}
+	}
+	return os.Remove(dir + "/" + mergeManifestName)
+}
+
+// removeTempFiles deletes the files left over by an interrupted merge or idx rebuild.
+func removeTempFiles(dir string) error {
+	dirFp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFp.Close()
+	names, err := dirFp.Readdirnames(-1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	for _, name := range names {
+		if existsSuffixs([]string{mergeSuffix, rebuildSuffix}, name) {
+			os.Remove(dir + "/" + name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"mousedb/pkg/assert"
+)
+
+func openTestStorage(t *testing.T, dir string) *Storage {
+	c := NewConfig()
+	c.Dir = dir
+	c.MaxFileSize = 200
+	c.MergeSecs = 0
+	s := New(c)
+	assert.Nil(t, s.Open())
+	return s
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+
+	// every round lands in a new data file, overwriting the previous round
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key-%d", i))
+			assert.Nil(t, s.Put(key, []byte(fmt.Sprintf("value-%d-%d", round, i))))
+		}
+		assert.Nil(t, s.Del([]byte("key-0")))
+		time.Sleep(1100 * time.Millisecond)
+	}
+	// rotate the last round out of the writeable file
+	assert.Nil(t, s.Put([]byte("last"), []byte("value")))
+
+	before, err := immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(before))
+
+	assert.Nil(t, s.Merge())
+
+	after, err := immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.T(t, len(after) < len(before), after)
+	assert.Equal(t, before[len(before)-len(after):], after)
+
+	check := func(s *Storage) {
+		_, err := s.Get([]byte("key-0"))
+		assert.Equal(t, ErrNotFound, err)
+		for i := 1; i < 10; i++ {
+			value, err := s.Get([]byte(fmt.Sprintf("key-%d", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("value-2-%d", i), string(value))
+		}
+		value, err := s.Get([]byte("last"))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(value))
+	}
+	check(s)
+
+	assert.Nil(t, s.Close())
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	check(s)
+}
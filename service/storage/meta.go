@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// The meta of a value is a uint32 kept apart from it for the protocols which
+// attach their own data to the values, like the flags of memcached. Get and
+// the other reads return the value without it, so a value reads the same in
+// every protocol. The record of a value with a meta has flagMeta and holds
+// the meta in the first 4 bytes of its value, before compression and
+// encryption. A meta of 0 isn't written.
+const metaSize = 4
+
+// withMeta returns value prefixed by meta, value as is if meta is 0, and the
+// flags the record gets for it.
+func withMeta(value []byte, meta uint32) ([]byte, uint32) {
+	if meta == 0 {
+		return value, 0
+	}
+	data := make([]byte, metaSize+len(value))
+	binary.BigEndian.PutUint32(data, meta)
+	copy(data[metaSize:], value)
+	return data, flagMeta
+}
+
+// splitMeta returns the value and meta of the decoded data of a record with flags.
+func splitMeta(flags uint32, data []byte) ([]byte, uint32, error) {
+	if flags&flagMeta == 0 {
+		return data, 0, nil
+	}
+	if len(data) < metaSize {
+		return nil, 0, fmt.Errorf("value of %d bytes is shorter than its meta", len(data))
+	}
+	return data[metaSize:], binary.BigEndian.Uint32(data), nil
+}
+
+// GetWithMeta returns the value of key with its meta and version.
+func (storage *Storage) GetWithMeta(key []byte) ([]byte, uint32, uint64, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
+
+	e := storage.liveEntry(key)
+	if e == nil {
+		return nil, 0, 0, ErrNotFound
+	}
+	value, meta, err := storage.readItem(key, e)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return value, meta, e.Version, nil
+}
+
+// PutWithMeta puts key/value with meta which expires after ttl, and returns
+// the new version. A ttl <= 0 never expires.
+func (storage *Storage) PutWithMeta(key, value []byte, meta uint32, ttl time.Duration) (uint64, error) {
+	var version uint64
+	err := storage.commit(func() error {
+		var err error
+		version, err = storage.put(key, value, meta, ttl)
+		return err
+	})
+	return version, err
+}
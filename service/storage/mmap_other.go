@@ -0,0 +1,15 @@
+//go:build !unix
+
+package storage
+
+import "errors"
+
+// mmapFile is not supported, the file is read with ReadAt.
+func (bf *BFile) mmapFile() error {
+	return errors.New("mmap is not supported on this platform")
+}
+
+// munmapFile releases the mapping made by mmapFile.
+func (bf *BFile) munmapFile() error {
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package storage
+
+import "golang.org/x/sys/unix"
+
+// mmapFile maps the whole file of bf read-only, an empty file isn't mapped.
+func (bf *BFile) mmapFile() error {
+	stat, err := bf.fp.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		return nil
+	}
+	data, err := unix.Mmap(int(bf.fp.Fd()), 0, int(stat.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	bf.mmap = data
+	return nil
+}
+
+// munmapFile releases the mapping made by mmapFile.
+func (bf *BFile) munmapFile() error {
+	if bf.mmap == nil {
+		return nil
+	}
+	data := bf.mmap
+	bf.mmap = nil
+	return unix.Munmap(data)
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrReadOnly is returned by the writes to a storage opened with Config.ReadWrite false.
+var ErrReadOnly = fmt.Errorf("storage is read only")
+
+// idxTail is how far an idx file has been replayed by a read only storage.
+type idxTail struct {
+	info   os.FileInfo
+	offset int64
+}
+
+// openReadOnly loads the keydir from the idx files as they are. It neither
+// takes the lock of the directory nor changes any file, so it can run next
+// to the writer and to other readers.
+func (storage *Storage) openReadOnly() error {
+	storage.tails = make(map[uint32]idxTail)
+	storage.entryCache = NewEntryCache()
+	files, err := storage.readableFiles()
+	if err != nil {
+		return err
+	}
+	defer closeIdxFiles(files)
+	if err := storage.parseIdx(files); err != nil {
+		return err
+	}
+
+	// follow the writer in background
+	if storage.Config.RefreshSecs > 0 {
+		storage.wg.Add(1)
+		go storage.refreshLoop()
+	}
+	return nil
+}
+
+// trackIdx remembers that the idx file fp is replayed up to offset.
+func (storage *Storage) trackIdx(fp *os.File, offset int64) {
+	fileID, err := fileIDFromName(fp.Name(), IDX)
+	if err != nil {
+		return
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		return
+	}
+	storage.tails[fileID] = idxTail{info: info, offset: offset}
+}
+
+// Refresh loads the records appended by the writer since the read only
+// storage was opened or last refreshed. If a merge of the writer replaced
+// files meanwhile the keydir is loaded again, unless the replaced files are
+// pinned by a snapshot. It does nothing in read-write mode, where the keydir
+// is always current.
+func (storage *Storage) Refresh() error {
+	if storage.Config.ReadWrite {
+		return nil
+	}
+	storage.refreshLock.Lock()
+	defer storage.refreshLock.Unlock()
+
+	files, err := storage.readableFiles()
+	if err != nil {
+		return err
+	}
+	defer closeIdxFiles(files)
+
+	// the files which are gone or have been replaced since the last refresh
+	var changed []uint32
+	seen := make(map[uint32]bool, len(files))
+	for _, fp := range files {
+		fileID, err := fileIDFromName(fp.Name(), IDX)
+		if err != nil {
+			return err
+		}
+		seen[fileID] = true
+		info, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		tail, ok := storage.tails[fileID]
+		if ok && (!os.SameFile(tail.info, info) || info.Size() < tail.offset) {
+			changed = append(changed, fileID)
+		}
+	}
+	for fileID := range storage.tails {
+		if !seen[fileID] {
+			changed = append(changed, fileID)
+		}
+	}
+	if len(changed) > 0 {
+		return storage.reload(files, changed)
+	}
+
+	for _, fp := range files {
+		fileID, _ := fileIDFromName(fp.Name(), IDX)
+		tail := storage.tails[fileID]
+		end, err := storage.loadIdx(storage.entryCache, fp, tail.offset)
+		if err != nil {
+			return err
+		}
+		storage.trackIdx(fp, end)
+	}
+	return nil
+}
+
+// reload loads the keydir again from all the idx files, and closes the data
+// files which changed.
+func (storage *Storage) reload(files []*os.File, changed []uint32) error {
+	if storage.oldFile.pinned(changed...) {
+		storage.Logger.Info("refresh postponed, data files are pinned by a snapshot")
+		return nil
+	}
+	cache := NewEntryCache()
+	tails := storage.tails
+	storage.tails = make(map[uint32]idxTail)
+	for _, fp := range files {
+		end, err := storage.loadIdx(cache, fp, 0)
+		if err != nil {
+			storage.tails = tails
+			return err
+		}
+		storage.trackIdx(fp, end)
+	}
+
+	storage.rwLock.Lock()
+	storage.entryCache.Replace(cache)
+	for _, fileID := range changed {
+		storage.oldFile.del(fileID)
+	}
+	storage.rwLock.Unlock()
+	storage.Logger.Info("reloaded the keydir", zap.Int("changed_files", len(changed)), zap.Int("keys", cache.Len()))
+	return nil
+}
+
+// refreshLoop runs Refresh every Config.RefreshSecs until the storage is closed.
+func (storage *Storage) refreshLoop() {
+	defer storage.wg.Done()
+	ticker := time.NewTicker(time.Duration(storage.Config.RefreshSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := storage.Refresh(); err != nil {
+				storage.Logger.Error("refresh the keydir failed", zap.Error(err))
+			}
+		case <-storage.closing:
+			return
+		}
+	}
+}
+
+func closeIdxFiles(files []*os.File) {
+	for _, fp := range files {
+		fp.Close()
+	}
+}
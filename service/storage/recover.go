@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+const (
+	rebuildSuffix = ".rebuild" // suffix of an idx file being regenerated from its data file
+)
+
+// errCorruptIdx is returned when an idx record can't belong to its data file.
+var errCorruptIdx = errors.New("corrupt idx record")
+
+// dataRecord is a record decoded from a data file.
+type dataRecord struct {
+	Offset    int64 // offset of the record header in the data file
+	Timestamp uint32
+	KeySize   uint32
+	ValueSize uint32
+	Flags     uint32
+	Expiry    uint32
+	Key       []byte
+}
+
+// size returns the size of the record in the data file.
+func (rec *dataRecord) size() int64 {
+	return int64(HeaderSize + rec.KeySize + rec.ValueSize)
+}
+
+// idx returns the idx record of the data record.
+func (rec *dataRecord) idx() *idxRecord {
+	return &idxRecord{
+		Timestamp:   rec.Timestamp,
+		KeySize:     rec.KeySize,
+		ValueSize:   rec.ValueSize,
+		ValueOffset: uint64(rec.Offset) + uint64(HeaderSize+rec.KeySize),
+		Flags:       rec.Flags,
+		Expiry:      rec.Expiry,
+		Key:         rec.Key,
+	}
+}
+
+// readRecordAt reads and verifies the record at offset of a data file of the given size.
+// It returns io.ErrUnexpectedEOF if the record is cut by the end of the file.
+func readRecordAt(fp *os.File, offset, size int64) (*dataRecord, error) {
+	if offset == size {
+		return nil, io.EOF
+	}
+	if offset+HeaderSize > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, HeaderSize)
+	if _, err := fp.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	_, _, ksz, valuesz, _, _ := DecodeEntryHeader(header)
+	if offset+HeaderSize+int64(ksz)+int64(valuesz) > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	buf := make([]byte, HeaderSize+ksz+valuesz)
+	if _, err := fp.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	_, tStamp, ksz, valuesz, flags, expiry, key, _, err := decodeEntryDetail(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &dataRecord{
+		Offset:    offset,
+		Timestamp: tStamp,
+		KeySize:   ksz,
+		ValueSize: valuesz,
+		Flags:     flags,
+		Expiry:    expiry,
+		Key:       key,
+	}, nil
+}
+
+// readIdxRecords reads the records of an idx file from offset and checks that
+// they fit in a data file of dataSize bytes.
+func readIdxRecords(fp *os.File, offset, dataSize int64) ([]*idxRecord, error) {
+	var recs []*idxRecord
+	err := walkIdxAt(fp, offset, func(rec *idxRecord) error {
+		if rec.ValueOffset < uint64(HeaderSize+rec.KeySize) ||
+			rec.ValueOffset+uint64(rec.ValueSize) > uint64(dataSize) {
+			return errCorruptIdx
+		}
+		recs = append(recs, rec)
+		return nil
+	})
+	return recs, err
+}
+
+// rebuildIdx regenerates the idx file of a data file by scanning it, and
+// returns the records written into it. The scan stops at the first record
+// failing its crc.
+func (storage *Storage) rebuildIdx(fileID uint32) ([]*idxRecord, error) {
+	name := fmt.Sprintf("%s/%d", storage.dirFile, fileID)
+	dataFp, err := os.Open(name + BSM)
+	if err != nil {
+		return nil, err
+	}
+	defer dataFp.Close()
+	stat, err := dataFp.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	tmpName := name + IDX + rebuildSuffix
+	idxFp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(idxFp)
+
+	var recs []*idxRecord
+	offset := int64(0)
+	for {
+		rec, err := readRecordAt(dataFp, offset, stat.Size())
+		if err != nil {
+			if err != io.EOF {
+				storage.Logger.Warn("stop rebuilding idx file at a bad record",
+					zap.String("file", name+BSM),
+					zap.Int64("offset", offset),
+					zap.Int64("discarded_bytes", stat.Size()-offset),
+					zap.Error(err))
+			}
+			break
+		}
+		ir := rec.idx()
+		w.Write(EncodeIdx(ir.Timestamp, ir.KeySize, ir.ValueSize, ir.ValueOffset, ir.Flags, ir.Expiry, ir.Key))
+		recs = append(recs, ir)
+		offset += rec.size()
+	}
+
+	if err := w.Flush(); err != nil {
+		idxFp.Close()
+		return nil, err
+	}
+	if err := idxFp.Sync(); err != nil {
+		idxFp.Close()
+		return nil, err
+	}
+	if err := idxFp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpName, name+IDX); err != nil {
+		return nil, err
+	}
+	storage.Logger.Info("rebuilt idx file", zap.String("file", name+IDX), zap.Int("records", len(recs)))
+	return recs, nil
+}
+
+// recoverFiles regenerates the missing idx files and repairs the tail of the
+// last data/idx pair, which is reopened as the writeable file.
+func (storage *Storage) recoverFiles() error {
+	ids, err := immutableFileIDs(storage, ^uint32(0))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		_, err := os.Stat(fmt.Sprintf("%s/%d%s", storage.dirFile, id, IDX))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		storage.Logger.Warn("idx file is missing", zap.Uint32("file_id", id))
+		if _, err := storage.rebuildIdx(id); err != nil {
+			return err
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return storage.recoverTail(ids[len(ids)-1])
+}
+
+// recoverTail truncates a partial trailing record left by a crash in the
+// middle of an append to the data/idx pair. Records in the data file which
+// didn't make it into the idx file are added to it.
+func (storage *Storage) recoverTail(fileID uint32) error {
+	name := fmt.Sprintf("%s/%d", storage.dirFile, fileID)
+	dataFp, err := os.OpenFile(name+BSM, os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer dataFp.Close()
+	idxFp, err := os.OpenFile(name+IDX, os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+	defer idxFp.Close()
+
+	dataStat, err := dataFp.Stat()
+	if err != nil {
+		return err
+	}
+	idxStat, err := idxFp.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the records at the end of the file, the ones missing from the idx file have no idxEnd
+	type tailRecord struct {
+		start  int64
+		end    int64
+		idxEnd int64
+		rec    *dataRecord
+		flags  uint32
+		key    []byte
+	}
+	var tail []tailRecord
+	idxEnd := int64(0)
+	err = walkIdx(idxFp, func(rec *idxRecord) error {
+		if rec.ValueOffset < uint64(HeaderSize+rec.KeySize) ||
+			rec.ValueOffset+uint64(rec.ValueSize) > uint64(dataStat.Size()) {
+			return errCorruptIdx
+		}
+		idxEnd += int64(IdxHeaderSize + rec.KeySize)
+		tail = append(tail, tailRecord{
+			start:  int64(rec.ValueOffset) - int64(HeaderSize+rec.KeySize),
+			end:    int64(rec.ValueOffset) + int64(rec.ValueSize),
+			idxEnd: idxEnd,
+			flags:  rec.Flags,
+			key:    rec.Key,
+		})
+		return nil
+	})
+	if err != nil && err != io.ErrUnexpectedEOF && err != errCorruptIdx {
+		return err
+	}
+
+	// a torn write may leave a record of the right size with the wrong content
+	for len(tail) > 0 {
+		last := tail[len(tail)-1]
+		if _, err := readRecordAt(dataFp, last.start, dataStat.Size()); err == nil {
+			break
+		}
+		tail = tail[:len(tail)-1]
+	}
+
+	// the data records which were written without their idx record
+	dataEnd := int64(0)
+	if len(tail) > 0 {
+		dataEnd = tail[len(tail)-1].end
+	}
+	for {
+		rec, err := readRecordAt(dataFp, dataEnd, dataStat.Size())
+		if err != nil {
+			break
+		}
+		tail = append(tail, tailRecord{
+			start: dataEnd,
+			end:   dataEnd + rec.size(),
+			rec:   rec,
+			flags: rec.Flags,
+			key:   rec.Key,
+		})
+		dataEnd += rec.size()
+	}
+
+	// a batch must be complete and match the crc32 of its footer
+	for i := len(tail) - 1; i >= 0; i-- {
+		if tail[i].flags&flagBatchEnd != 0 {
+			break
+		}
+		if tail[i].flags&flagBatchBegin == 0 {
+			continue
+		}
+		cut := true
+		for j := i + 1; j < len(tail); j++ {
+			if tail[j].flags&flagBatchEnd != 0 {
+				cut = !checkBatchBody(dataFp, tail[i].end, tail[j].start, tail[j].key)
+				break
+			}
+		}
+		if cut {
+			tail = tail[:i]
+		}
+		break
+	}
+
+	dataEnd, idxEnd = 0, 0
+	var missing []byte
+	for _, t := range tail {
+		dataEnd = t.end
+		if t.rec == nil {
+			idxEnd = t.idxEnd
+			continue
+		}
+		ir := t.rec.idx()
+		missing = append(missing, EncodeIdx(ir.Timestamp, ir.KeySize, ir.ValueSize, ir.ValueOffset, ir.Flags, ir.Expiry, ir.Key)...)
+	}
+
+	if dataEnd == dataStat.Size() && idxEnd == idxStat.Size() && len(missing) == 0 {
+		return nil
+	}
+	storage.Logger.Warn("recover the tail of the data file",
+		zap.String("file", name+BSM),
+		zap.Int64("discarded_data_bytes", dataStat.Size()-dataEnd),
+		zap.Int64("discarded_idx_bytes", idxStat.Size()-idxEnd),
+		zap.Int("recovered_idx_bytes", len(missing)))
+
+	if err := dataFp.Truncate(dataEnd); err != nil {
+		return err
+	}
+	if err := idxFp.Truncate(idxEnd); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		if _, err := idxFp.WriteAt(missing, idxEnd); err != nil {
+			return err
+		}
+	}
+	if err := dataFp.Sync(); err != nil {
+		return err
+	}
+	return idxFp.Sync()
+}
+
+// checkBatchBody verifies the records of a batch between start and end of the
+// data file against the crc32 kept in the key of the batch footer.
+func checkBatchBody(dataFp *os.File, start, end int64, footerKey []byte) bool {
+	if len(footerKey) != 8 {
+		return false
+	}
+	body := make([]byte, end-start)
+	if _, err := dataFp.ReadAt(body, start); err != nil {
+		return false
+	}
+	return crc32.ChecksumIEEE(body) == binary.LittleEndian.Uint32(footerKey[4:])
+}
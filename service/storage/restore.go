@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	restoreSuffix = ".restore" // suffix of a data file being cut at the point in time of a restore
+)
+
+// ErrBadBackup is returned when a backup doesn't match its manifest.
+var ErrBadBackup = errors.New("backup does not match its manifest")
+
+// RestoreOptions tunes a restore.
+type RestoreOptions struct {
+	// Until keeps only the records written at or before it, zero keeps all.
+	// Merged files only hold the last version of a key, so a key overwritten
+	// after Until in a merged file is gone rather than rolled back.
+	Until  time.Time
+	Logger *zap.Logger
+}
+
+// Restore verifies the tar stream r written by Storage.Backup against its
+// manifest and lays its files into dir, which must not exist or be empty.
+// dir is then ready to be opened as the Dir of a Storage.
+func Restore(r io.Reader, dir string, opts *RestoreOptions) (*BackupManifest, error) {
+	opts = restoreDefaults(opts)
+	if err := emptyDir(dir); err != nil {
+		return nil, err
+	}
+
+	var manifest *BackupManifest
+	files := make(map[string]BackupFile)
+	var written []string
+	err := func() error {
+		tr := tar.NewReader(r)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if header.Name == BackupManifestName {
+				manifest = &BackupManifest{}
+				if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+					return fmt.Errorf("%w: %v", ErrBadBackup, err)
+				}
+				continue
+			}
+			if !backupFileName(header.Name) {
+				return fmt.Errorf("%w: unexpected file %s", ErrBadBackup, header.Name)
+			}
+			written = append(written, header.Name)
+			sum, err := writeFileSum(filepath.Join(dir, header.Name), tr, header.Size)
+			if err != nil {
+				return err
+			}
+			files[header.Name] = BackupFile{Name: header.Name, Size: header.Size, SHA256: sum}
+		}
+	}()
+	if err == nil {
+		err = verifyManifest(manifest, files)
+	}
+	if err != nil {
+		for _, name := range written {
+			os.Remove(filepath.Join(dir, name))
+		}
+		return nil, err
+	}
+	return manifest, finishRestore(dir, manifest, opts)
+}
+
+// RestoreDir verifies the backup written into backupDir by Storage.BackupDir
+// against its manifest and copies its files into dir, which must not exist
+// or be empty. dir is then ready to be opened as the Dir of a Storage.
+func RestoreDir(backupDir, dir string, opts *RestoreOptions) (*BackupManifest, error) {
+	opts = restoreDefaults(opts)
+	data, err := os.ReadFile(filepath.Join(backupDir, BackupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadBackup, err)
+	}
+	if err := emptyDir(dir); err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]BackupFile)
+	var written []string
+	err = func() error {
+		for _, f := range manifest.Files {
+			if !backupFileName(f.Name) {
+				return fmt.Errorf("%w: unexpected file %s", ErrBadBackup, f.Name)
+			}
+			fp, err := os.Open(filepath.Join(backupDir, f.Name))
+			if err != nil {
+				return err
+			}
+			written = append(written, f.Name)
+			sum, err := writeFileSum(filepath.Join(dir, f.Name), fp, f.Size)
+			fp.Close()
+			if err != nil {
+				return err
+			}
+			files[f.Name] = BackupFile{Name: f.Name, Size: f.Size, SHA256: sum}
+		}
+		return nil
+	}()
+	if err == nil {
+		err = verifyManifest(manifest, files)
+	}
+	if err != nil {
+		for _, name := range written {
+			os.Remove(filepath.Join(dir, name))
+		}
+		return nil, err
+	}
+	return manifest, finishRestore(dir, manifest, opts)
+}
+
+func restoreDefaults(opts *RestoreOptions) *RestoreOptions {
+	o := RestoreOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Logger == nil {
+		o.Logger = zap.NewNop()
+	}
+	return &o
+}
+
+// emptyDir makes sure dir exists and is empty.
+func emptyDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("dir %s is not empty", dir)
+	}
+	return nil
+}
+
+// backupFileName reports whether name is a data or idx file, with no path.
+func backupFileName(name string) bool {
+	if filepath.Base(name) != name {
+		return false
+	}
+	if _, err := fileIDFromName(name, BSM); err == nil {
+		return true
+	}
+	_, err := fileIDFromName(name, IDX)
+	return err == nil
+}
+
+// writeFileSum copies the first size bytes of r into the new file dst and
+// returns their sha256.
+func writeFileSum(dst string, r io.Reader, size int64) (string, error) {
+	fp, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fp, h), io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("%w: %s is short", ErrBadBackup, filepath.Base(dst))
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// verifyManifest checks that the restored files are exactly the files of the manifest.
+func verifyManifest(manifest *BackupManifest, files map[string]BackupFile) error {
+	if manifest == nil {
+		return fmt.Errorf("%w: %s is missing", ErrBadBackup, BackupManifestName)
+	}
+	if len(manifest.Files) != len(files) {
+		return fmt.Errorf("%w: %d files, the manifest lists %d", ErrBadBackup, len(files), len(manifest.Files))
+	}
+	for _, want := range manifest.Files {
+		got, ok := files[want.Name]
+		if !ok {
+			return fmt.Errorf("%w: %s is missing", ErrBadBackup, want.Name)
+		}
+		if got.Size != want.Size || got.SHA256 != want.SHA256 {
+			return fmt.Errorf("%w: checksum of %s", ErrBadBackup, want.Name)
+		}
+	}
+	return nil
+}
+
+// finishRestore cuts the restored files at opts.Until.
+func finishRestore(dir string, manifest *BackupManifest, opts *RestoreOptions) error {
+	if opts.Until.IsZero() {
+		opts.Logger.Info("restore finished", zap.String("dir", dir), zap.Int("files", len(manifest.Files)))
+		return nil
+	}
+	until := uint32(opts.Until.Unix())
+	restorer := &Storage{dirFile: dir, Logger: opts.Logger}
+	ids, err := immutableFileIDs(restorer, ^uint32(0))
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, id := range ids {
+		n, err := restorer.cutFile(id, until)
+		if err != nil {
+			return err
+		}
+		dropped += n
+	}
+	opts.Logger.Info("restore finished",
+		zap.String("dir", dir),
+		zap.Int("files", len(manifest.Files)),
+		zap.Time("until", opts.Until),
+		zap.Int("dropped_records", dropped))
+	return nil
+}
+
+// cutFile drops the records of a data file written after until, and
+// regenerates its idx file. The pair is removed if no record is left. It
+// returns the number of records dropped.
+func (storage *Storage) cutFile(fileID uint32, until uint32) (int, error) {
+	name := fmt.Sprintf("%s/%d", storage.dirFile, fileID)
+	dataFp, err := os.Open(name + BSM)
+	if err != nil {
+		return 0, err
+	}
+	defer dataFp.Close()
+	stat, err := dataFp.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	// a backup taken in read only mode may end with a partial record, the
+	// scan stops there
+	var kept []*dataRecord
+	dropped := 0
+	offset := int64(0)
+	for {
+		rec, err := readRecordAt(dataFp, offset, stat.Size())
+		if err != nil {
+			break
+		}
+		if rec.Timestamp <= until {
+			kept = append(kept, rec)
+		} else {
+			dropped++
+		}
+		offset += rec.size()
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	if len(kept) == 0 {
+		if err := os.Remove(name + BSM); err != nil {
+			return 0, err
+		}
+		return dropped, os.Remove(name + IDX)
+	}
+
+	tmpName := name + BSM + restoreSuffix
+	fp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(fp)
+	for _, rec := range kept {
+		buf := make([]byte, rec.size())
+		if _, err = dataFp.ReadAt(buf, rec.Offset); err != nil {
+			break
+		}
+		if _, err = w.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return 0, err
+	}
+	if err := os.Rename(tmpName, name+BSM); err != nil {
+		return 0, err
+	}
+	if _, err := storage.rebuildIdx(fileID); err != nil {
+		return 0, err
+	}
+	return dropped, nil
+}
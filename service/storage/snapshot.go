@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Snapshot is a read-only, point in time view of a Storage. It keeps the
+// keydir as it was when the snapshot was taken and pins the data files, so
+// merge leaves them alone until the snapshot is released.
+type Snapshot struct {
+	storage *Storage
+	view    keydirView // keydir at the time of the snapshot
+	fileIDs []uint32   // pinned data files
+
+	once sync.Once
+}
+
+// Snapshot returns a snapshot of the current state, it must be released
+// with Release once it is no longer used.
+func (storage *Storage) Snapshot() (*Snapshot, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
+
+	// the files of a read only storage are all pinned, the writer may be elsewhere
+	activeID := ^uint32(0)
+	if storage.writeFile != nil {
+		activeID = storage.writeFile.fileID
+	}
+	fileIDs, err := immutableFileIDs(storage, activeID)
+	if err != nil {
+		return nil, err
+	}
+	if storage.writeFile != nil {
+		fileIDs = append(fileIDs, activeID)
+	}
+	storage.oldFile.pin(fileIDs...)
+	return &Snapshot{
+		storage: storage,
+		view:    storage.entryCache.Root(),
+		fileIDs: fileIDs,
+	}, nil
+}
+
+// Get returns the value of key at the time of the snapshot.
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	value, _, err := snap.getWithMeta(key)
+	return value, err
+}
+
+// getWithMeta returns the value of key with its meta at the time of the snapshot.
+func (snap *Snapshot) getWithMeta(key []byte) ([]byte, uint32, error) {
+	n := viewGet(&snap.view, string(key))
+	if n == nil || n.e.IsExpired(time.Now()) {
+		return nil, 0, ErrNotFound
+	}
+	snap.storage.rwLock.RLock()
+	defer snap.storage.rwLock.RUnlock()
+	return snap.storage.readItem(key, &n.e)
+}
+
+// NewIterator returns an Iterator over the keys of the snapshot within opts.
+func (snap *Snapshot) NewIterator(opts *IteratorOptions) *Iterator {
+	it := snap.storage.NewIterator(opts)
+	it.snap = snap
+	return it
+}
+
+// Release unpins the data files of the snapshot, it is safe to call it more than once.
+func (snap *Snapshot) Release() {
+	snap.once.Do(func() {
+		snap.storage.oldFile.unpin(snap.fileIDs...)
+	})
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "sync/atomic"
+
+// Stats represents the counters of a Storage.
+type Stats struct {
+	ChecksumFailures uint64 // values which failed their crc32 check on Get
+	Syncs            uint64 // fsyncs of the writeable file
+	WriteGroups      uint64 // groups of writes flushed together by the writer
+
+	KeydirKeys       uint64 // keys in the keydir
+	KeydirKeyBytes   uint64 // bytes of the keys in the keydir
+	KeydirArenaBytes uint64 // bytes of the chunks the keys are packed in, including deleted keys not reclaimed yet
+	KeydirNodeBytes  uint64 // bytes of the keydir nodes, which hold the entries
+}
+
+// Stats returns a copy of the current counters.
+func (storage *Storage) Stats() Stats {
+	stats := Stats{
+		ChecksumFailures: atomic.LoadUint64(&storage.stats.ChecksumFailures),
+		Syncs:            atomic.LoadUint64(&storage.stats.Syncs),
+		WriteGroups:      atomic.LoadUint64(&storage.stats.WriteGroups),
+	}
+	if storage.entryCache != nil {
+		m := storage.entryCache.memory()
+		stats.KeydirKeys = m.keys
+		stats.KeydirKeyBytes = m.keyBytes
+		stats.KeydirArenaBytes = m.arenaBytes
+		stats.KeydirNodeBytes = m.nodeBytes
+	}
+	return stats
+}
@@ -1,12 +1,15 @@
 package storage
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -15,6 +18,9 @@ import (
 var (
 	ErrNotFound = fmt.Errorf("not Found")
 	ErrIsNotDir = fmt.Errorf("the file is not dir")
+
+	ErrKeyExists       = fmt.Errorf("key exists")
+	ErrVersionMismatch = fmt.Errorf("version mismatch")
 )
 
 // New a Storage service
@@ -31,35 +37,73 @@ func (storage *Storage) WithLogger(log *zap.Logger) {
 	storage.Logger = log.With(zap.String("service", "storage"))
 }
 
-func (storage *Storage) Open() error {
+func (storage *Storage) Open() (err error) {
 	if storage.Config == nil {
 		storage.Config = NewConfig()
 	}
 
-	_, err := os.Stat(storage.Config.Dir)
+	_, err = os.Stat(storage.Config.Dir)
 	if err != nil && !os.IsNotExist(err) {
 		return nil
 	}
 
 	if os.IsNotExist(err) {
-		err = os.Mkdir(storage.Config.Dir, 0755)
+		if !storage.Config.ReadWrite {
+			return err
+		}
+		err = os.MkdirAll(storage.Config.Dir, 0755)
 		if err != nil {
 			return err
 		}
 	}
+	storage.codec, err = codecByName(storage.Config.Compression)
+	if err != nil {
+		return err
+	}
+	storage.keys, err = loadKeyring(storage.Config)
+	if err != nil {
+		return err
+	}
 	storage.dirFile = storage.Config.Dir
 	storage.oldFile = newBFiles()
 	storage.rwLock = &sync.RWMutex{}
+	storage.closing = make(chan struct{})
+	storage.writes = make(chan *writeRequest)
+	// versions don't repeat across restarts
+	storage.version = uint64(time.Now().UnixNano())
+
+	if !storage.Config.ReadWrite {
+		return storage.openReadOnly()
+	}
 
 	// lock file
-	storage.lockFile, err = lockFile(storage.Config.Dir + "/" + lockFileName)
+	timeout := time.Duration(storage.Config.OpenTimeoutSecs) * time.Second
+	storage.lockFile, err = storage.lockDir(storage.Config.Dir+"/"+lockFileName, timeout)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			storage.lockFile.Close()
+		}
+	}()
+	// finish or drop the output of an interrupted merge
+	if err := replayMergeManifest(storage.dirFile); err != nil {
+		return err
+	}
+	if err := removeTempFiles(storage.dirFile); err != nil {
+		return err
+	}
+	// repair the files left by a crash
+	if err := storage.recoverFiles(); err != nil {
+		return err
+	}
 	storage.entryCache = NewEntryCache()
 	// scan readAble file
 	files, _ := storage.readableFiles()
-	storage.parseIdx(files)
+	if err := storage.parseIdx(files); err != nil {
+		return err
+	}
 
 	//get the last fileid
 	fileId, idxFp := lastFileInfo(files)
@@ -74,17 +118,36 @@ func (storage *Storage) Open() error {
 
 	// setting writeable file, only one
 	dataSet, _ := writeFp.Stat()
+	idxSet, _ := idxFp.Stat()
 	bf := &BFile{
 		fp:          writeFp,
 		fileID:      fileId,
 		writeOffset: uint64(dataSet.Size()),
+		flushOffset: uint64(dataSet.Size()),
 		idxFp:       idxFp,
+		idxOffset:   idxSet.Size(),
 	}
 	storage.writeFile = bf
 
 	// save pid into mousedb.lock file
 	writePID(storage.lockFile, fileId)
 
+	// append the writes
+	storage.wg.Add(1)
+	go storage.writeLoop()
+
+	// sync the writes in background
+	if storage.Config.SyncMode == SyncInterval {
+		storage.wg.Add(1)
+		go storage.syncLoop()
+	}
+
+	// merge the immutable files in background
+	if storage.Config.MergeSecs > 0 {
+		storage.wg.Add(1)
+		go storage.mergeLoop()
+	}
+
 	return nil
 }
 
@@ -93,20 +156,55 @@ type Storage struct {
 	Logger     *zap.Logger
 	baseLogger *zap.Logger
 
-	Config     *Config       // config for Storage
-	oldFile    *BFiles       // idx file, data file
-	lockFile   *os.File      // lock file with process
-	entryCache *EntryCache   // key/value hashMap, building with idx file
-	dirFile    string        // mousedb storage  root dir
-	writeFile  *BFile        // writeable file
-	rwLock     *sync.RWMutex // rwlocker for mousedb Get and put Operation
-
+	Config      *Config            // config for Storage
+	oldFile     *BFiles            // idx file, data file
+	lockFile    *os.File           // lock file with process
+	entryCache  *EntryCache        // key/value hashMap, building with idx file
+	dirFile     string             // mousedb storage  root dir
+	writeFile   *BFile             // writeable file
+	rwLock      *sync.RWMutex      // rwlocker for mousedb Get and put Operation
+	mergeLock   sync.Mutex         // only one merge runs at a time
+	stats       Stats              // counters, updated atomically
+	version     uint64             // last version given to an entry
+	written     uint64             // number of writes appended, guarded by rwLock
+	flushed     uint64             // number of writes flushed to the writeable file, guarded by rwLock
+	failed      error              // the failed flush or sync which stopped the writes, guarded by rwLock
+	writes      chan *writeRequest // the writes waiting for the writer
+	codec       Codec              // codec of the values written, nil writes them raw
+	keys        *keyring           // keys of the encrypted records, nil writes them in plaintext
+	tails       map[uint32]idxTail // read only: how far the idx files are replayed, guarded by refreshLock
+	refreshLock sync.Mutex         // only one refresh runs at a time
+
+	syncLock sync.Mutex
+	synced   uint64 // number of writes known to be on disk, guarded by syncLock
+
+	closing chan struct{} // closed to stop the background goroutines
+	wg      sync.WaitGroup
 }
 
 // Close opening fp
 func (storage *Storage) Close() error {
+	// stop merging
+	close(storage.closing)
+	storage.wg.Wait()
 	// close ActiveFiles
 	storage.oldFile.close()
+	// there is nothing else to close in read only mode
+	if storage.writeFile == nil {
+		return nil
+	}
+	// flush the last writes, unless the storage failed: the writes left
+	// buffered by the failed flush were replied with its error
+	if storage.failed == nil {
+		if err := storage.writeFile.flush(); err != nil {
+			return err
+		}
+		if storage.Config.SyncMode != SyncNone {
+			if err := storage.writeFile.fp.Sync(); err != nil {
+				return err
+			}
+		}
+	}
 	// close writeable file
 	if err := storage.writeFile.fp.Close(); err != nil {
 		return err
@@ -114,53 +212,126 @@ func (storage *Storage) Close() error {
 	if err := storage.writeFile.idxFp.Close(); err != nil {
 		return err
 	}
-	// close lockFile
-	if err := storage.lockFile.Close(); err != nil {
-		return err
-	}
-	// delete lockFile
-	os.Remove(storage.dirFile + "/" + lockFileName)
-	return nil
+	// the lock file stays, removing it would let another process lock a new
+	// file while a third one waits on the removed one
+	storage.lockFile.Truncate(0)
+	return storage.lockFile.Close()
 }
 
-// Put key/value
+// Put key/value, the key expires after Config.ExpirySecs if it is set
 func (storage *Storage) Put(key []byte, value []byte) error {
-	storage.rwLock.Lock()
-	defer storage.rwLock.Unlock()
-	checkWriteableFile(storage)
+	return storage.PutWithTTL(key, value, time.Duration(storage.Config.ExpirySecs)*time.Second)
+}
+
+// PutWithTTL puts key/value which expires after ttl, a ttl <= 0 never expires
+func (storage *Storage) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	return storage.commit(func() error {
+		_, err := storage.put(key, value, 0, ttl)
+		return err
+	})
+}
+
+// put writes key/value with meta and returns the version of the new entry, it
+// runs on the writer.
+func (storage *Storage) put(key []byte, value []byte, meta uint32, ttl time.Duration) (uint64, error) {
+	diskKey, data, flags, err := storage.encodeRecord(key, value, meta)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkWriteableFile(storage); err != nil {
+		return 0, err
+	}
 	// write data into writeable file
-	e, err := storage.writeFile.writeDatat(key, value)
+	e, err := storage.writeFile.writeDatat(diskKey, data, flags, expiryOf(ttl))
 	if err != nil {
-		storage.rwLock.Unlock()
-		return err
+		return 0, err
 	}
+	e.Version = storage.nextVersion()
 	// add key/value into EntryCache
 	storage.entryCache.Put(string(key), &e)
-	return nil
+	return e.Version, nil
 }
 
 // Get ...
 func (storage *Storage) Get(key []byte) ([]byte, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
 
 	e := storage.entryCache.Get(string(key))
-	if e == nil {
+	if e == nil || e.IsExpired(time.Now()) {
 		return nil, ErrNotFound
 	}
+	return storage.readValue(key, e)
+}
 
+// TTL returns how long key is left to live, 0 if it never expires. It
+// returns ErrNotFound if the key doesn't exist.
+func (storage *Storage) TTL(key []byte) (time.Duration, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
+
+	e := storage.liveEntry(key)
+	if e == nil {
+		return 0, ErrNotFound
+	}
+	if e.Expiry == 0 {
+		return 0, nil
+	}
+	return time.Until(time.Unix(int64(e.Expiry), 0)), nil
+}
+
+// nextVersion returns a new version for an entry.
+func (storage *Storage) nextVersion() uint64 {
+	return atomic.AddUint64(&storage.version, 1)
+}
+
+// readValue reads the value of the entry e of key, the caller must hold rwLock.
+func (storage *Storage) readValue(key []byte, e *entry) ([]byte, error) {
+	value, _, err := storage.readItem(key, e)
+	return value, err
+}
+
+// readItem reads the value of the entry e of key with its meta, the caller
+// must hold rwLock.
+func (storage *Storage) readItem(key []byte, e *entry) ([]byte, uint32, error) {
 	fileID := e.FileID
 	bf, err := storage.getFileState(fileID)
-	if err != nil && os.IsNotExist(err) {
+	if err != nil {
 		storage.Logger.Info("The key is not exits", zap.Error(err))
-		return nil, err
+		return nil, 0, err
 	}
 
-	return bf.read(e.ValueOffset, e.ValueSize)
+	var data []byte
+	if !storage.Config.CheckSumCrc32 {
+		data, err = bf.read(e.ValueOffset, e.ValueSize)
+	} else {
+		data, err = bf.readChecked(e.KeySize, e.ValueOffset, e.ValueSize)
+		if errors.Is(err, ErrCrc32) {
+			atomic.AddUint64(&storage.stats.ChecksumFailures, 1)
+			storage.Logger.Error("checksum of the value failed", zap.ByteString("key", key), zap.Error(err))
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if data, err = storage.keys.open(e.Flags, data, key); err != nil {
+		return nil, 0, err
+	}
+	if data, err = decodeValue(e.Flags, data); err != nil {
+		return nil, 0, err
+	}
+	return splitMeta(e.Flags, data)
 }
 
 // Del value by key
 func (storage *Storage) Del(key []byte) error {
-	storage.rwLock.Lock()
-	defer storage.rwLock.Unlock()
+	return storage.commit(func() error {
+		return storage.del(key)
+	})
+}
+
+// del writes a tombstone of key, it runs on the writer.
+func (storage *Storage) del(key []byte) error {
 	if storage.writeFile == nil {
 		return fmt.Errorf("can Not Read The MouseDB Root Director")
 	}
@@ -168,10 +339,21 @@ func (storage *Storage) Del(key []byte) error {
 	if e == nil {
 		return ErrNotFound
 	}
+	// an expired key is gone already, there is nothing to write
+	if e.IsExpired(time.Now()) {
+		storage.entryCache.Del(string(key))
+		return ErrNotFound
+	}
 
-	checkWriteableFile(storage)
+	diskKey, flags, err := storage.encodeTombstone(key)
+	if err != nil {
+		return err
+	}
+	if err := checkWriteableFile(storage); err != nil {
+		return err
+	}
 	// write data into writeable file
-	err := storage.writeFile.del(key)
+	err = storage.writeFile.del(diskKey, flags)
 	if err != nil {
 		return err
 	}
@@ -180,13 +362,18 @@ func (storage *Storage) Del(key []byte) error {
 	return nil
 }
 
-// return readable idx file: xxxx.idx
+// return readable idx file: xxxx.idx, sorted by file id
 func (storage *Storage) readableFiles() ([]*os.File, error) {
 	filterFiles := []string{lockFileName}
 	ldfs, err := listIdxFiles(storage)
 	if err != nil {
 		return nil, err
 	}
+	sort.Slice(ldfs, func(i, j int) bool {
+		a, _ := fileIDFromName(ldfs[i], IDX)
+		b, _ := fileIDFromName(ldfs[j], IDX)
+		return a < b
+	})
 
 	fps := make([]*os.File, 0, len(ldfs))
 	for _, filePath := range ldfs {
@@ -207,7 +394,7 @@ func (storage *Storage) readableFiles() ([]*os.File, error) {
 
 func (storage *Storage) getFileState(fileID uint32) (*BFile, error) {
 	// lock up it from write able file
-	if fileID == storage.writeFile.fileID {
+	if storage.writeFile != nil && fileID == storage.writeFile.fileID {
 		return storage.writeFile, nil
 	}
 	// if not exits in write able file, look up it from OldFile
@@ -220,63 +407,122 @@ func (storage *Storage) getFileState(fileID uint32) (*BFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	storage.oldFile.put(bf, fileID)
-	return bf, nil
+	if storage.Config.MmapReads {
+		if err := bf.mmapFile(); err != nil {
+			storage.Logger.Warn("mmap data file failed, read it with ReadAt", zap.Uint32("file_id", fileID), zap.Error(err))
+		}
+	}
+	// another reader may have opened the file meanwhile, only one is kept
+	return storage.oldFile.put(bf, fileID), nil
 }
 
-func (storage *Storage) parseIdx(idxFps []*os.File) {
-
-	b := make([]byte, IdxHeaderSize, IdxHeaderSize)
+// parseIdx replays the idx files in file id order, a later record of a key
+// always wins over an older one and a tombstone removes the key. A corrupt
+// idx file is regenerated from its data file.
+func (storage *Storage) parseIdx(idxFps []*os.File) error {
 	for _, fp := range idxFps {
-		offset := int64(0)
-		idxName := fp.Name()
-		s := strings.LastIndex(idxName, "/") + 1
-		e := strings.LastIndex(idxName, IDX)
-		fileID, _ := strconv.ParseInt(idxName[s:e], 10, 32)
-
-		for {
-			// parse idx header
-			n, err := fp.ReadAt(b, offset)
-			offset += int64(n)
-			if err != nil && err != io.EOF {
-				panic(err)
-			}
-			if err == io.EOF {
-				break
-			}
+		end, err := storage.loadIdx(storage.entryCache, fp, 0)
+		if err != nil {
+			return err
+		}
+		if !storage.Config.ReadWrite {
+			storage.trackIdx(fp, end)
+		}
+	}
+	return nil
+}
 
-			if n != IdxHeaderSize {
-				panic(n)
-			}
+// loadIdx replays the records of an idx file from offset into cache, and
+// returns the offset following the last record applied. In read only mode
+// the writer may be appending to the file: a partial record or a batch
+// without its footer is left for the next call.
+func (storage *Storage) loadIdx(cache *EntryCache, fp *os.File, offset int64) (int64, error) {
+	fileID, err := fileIDFromName(fp.Name(), IDX)
+	if err != nil {
+		return offset, err
+	}
+	dataStat, err := os.Stat(fmt.Sprintf("%s/%d%s", storage.dirFile, fileID, BSM))
+	if err != nil {
+		storage.Logger.Warn("skip idx file without data file", zap.String("file", fp.Name()), zap.Error(err))
+		return offset, nil
+	}
 
-			timestamp, ksz, valueSz, valuePos := DecodeIdx(b)
-			if ksz+valueSz == 0 { // the record is deleted
-				continue
-			}
+	recs, err := readIdxRecords(fp, offset, dataStat.Size())
+	switch {
+	case err == nil:
+	case !storage.Config.ReadWrite:
+		// the records read so far are complete, the rest may not be written yet
+		if err != io.ErrUnexpectedEOF {
+			storage.Logger.Warn("idx file is corrupt", zap.String("file", fp.Name()), zap.Error(err))
+		}
+	default:
+		storage.Logger.Warn("idx file is corrupt", zap.String("file", fp.Name()), zap.Error(err))
+		if recs, err = storage.rebuildIdx(fileID); err != nil {
+			return offset, fmt.Errorf("rebuild %s: %v", fp.Name(), err)
+		}
+	}
+	if err := storage.openIdxKeys(recs); err != nil {
+		return offset, fmt.Errorf("%s: %w", fp.Name(), err)
+	}
 
-			// parse idx key
-			keyByte := make([]byte, ksz)
-			n, err = fp.ReadAt(keyByte, offset)
-			if err != nil && err != io.EOF {
-				panic(err)
+	// the records of a batch are only applied once its footer is read
+	now := time.Now()
+	var batch []*idxRecord
+	var batchCount uint32
+	inBatch := false
+	pos, end := offset, offset
+	for _, rec := range recs {
+		size := int64(IdxHeaderSize + rec.KeySize)
+		pos += size
+		switch {
+		case rec.Flags&flagBatchBegin != 0:
+			if inBatch {
+				storage.Logger.Warn("discard an incomplete batch", zap.String("file", fp.Name()), zap.Int("records", len(batch)))
+				end = pos - size
 			}
-			if err == io.EOF {
-				break
+			batch, inBatch = batch[:0], true
+			batchCount = ^uint32(0)
+			if len(rec.Key) == 4 {
+				batchCount = binary.LittleEndian.Uint32(rec.Key)
 			}
-			if n != int(ksz) {
-				panic(n)
+		case rec.Flags&flagBatchEnd != 0:
+			if inBatch && uint32(len(batch)) == batchCount {
+				storage.applyIdx(cache, fileID, batch, now)
 			}
-			key := string(keyByte)
+			batch, inBatch = batch[:0], false
+			end = pos
+		case inBatch:
+			batch = append(batch, rec)
+		default:
+			storage.applyIdx(cache, fileID, []*idxRecord{rec}, now)
+			end = pos
+		}
+	}
+	if inBatch && storage.Config.ReadWrite {
+		storage.Logger.Warn("discard an incomplete batch", zap.String("file", fp.Name()), zap.Int("records", len(batch)))
+	}
+	return end, nil
+}
 
-			e := &entry{
-				FileID:      uint32(fileID),
-				ValueSize:   valueSz,
-				ValueOffset: valuePos,
-				Timestamp:   timestamp,
-			}
-			offset += int64(ksz)
-			// put entry into EntryCache
-			storage.entryCache.Put(key, e)
+// applyIdx puts the records of the idx file fileID into cache under a single lock.
+func (storage *Storage) applyIdx(cache *EntryCache, fileID uint32, recs []*idxRecord, now time.Time) {
+	keys := make([]string, len(recs))
+	es := make([]*entry, len(recs))
+	for i, rec := range recs {
+		keys[i] = string(rec.Key)
+		e := &entry{
+			FileID:      fileID,
+			KeySize:     rec.KeySize,
+			ValueSize:   rec.ValueSize,
+			ValueOffset: rec.ValueOffset,
+			Timestamp:   rec.Timestamp,
+			Expiry:      rec.Expiry,
+			Version:     storage.nextVersion(),
+			Flags:       rec.Flags,
+		}
+		if rec.Flags&flagTombstone == 0 && !e.IsExpired(now) {
+			es[i] = e
 		}
 	}
+	cache.Apply(keys, es)
 }
@@ -0,0 +1,894 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mousedb/pkg/assert"
+)
+
+func TestDelSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar")))
+	assert.Nil(t, s.Put([]byte("baz"), []byte("qux")))
+	assert.Nil(t, s.Del([]byte("foo")))
+	assert.Equal(t, ErrNotFound, s.Del([]byte("foo")))
+	assert.Nil(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	_, err := s.Get([]byte("foo"))
+	assert.Equal(t, ErrNotFound, err)
+	value, err := s.Get([]byte("baz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "qux", string(value))
+
+	// put the key again after the tombstone
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar2")))
+	assert.Nil(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	value, err = s.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bar2", string(value))
+}
+
+func TestOpenRecoversTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar")))
+	assert.Nil(t, s.Put([]byte("baz"), []byte("qux")))
+	name := fmt.Sprintf("%s/%d", dir, s.writeFile.fileID)
+	assert.Nil(t, s.Close())
+
+	// a record written to the data file but not to the idx file
+	idxStat, err := os.Stat(name + IDX)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(name+IDX, idxStat.Size()-3))
+	// a partial record at the end of the data file
+	fp, err := os.OpenFile(name+BSM, os.O_APPEND|os.O_WRONLY, 0755)
+	assert.Nil(t, err)
+	_, err = fp.Write(encodeEntry(1, 3, 5, 0, 0, []byte("new"), []byte("value"))[:HeaderSize+4])
+	assert.Nil(t, err)
+	assert.Nil(t, fp.Close())
+
+	s = openTestStorage(t, dir)
+	for key, value := range map[string]string{"foo": "bar", "baz": "qux"} {
+		got, err := s.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(got))
+	}
+	assert.Nil(t, s.Put([]byte("new"), []byte("value")))
+	assert.Nil(t, s.Close())
+
+	// a missing idx file is regenerated from the data file
+	assert.Nil(t, os.Remove(name+IDX))
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	for key, value := range map[string]string{"foo": "bar", "baz": "qux", "new": "value"} {
+		got, err := s.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, string(got))
+	}
+}
+
+func TestGetVerifiesCrc32(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	defer s.Close()
+	s.Config.CheckSumCrc32 = true
+	assert.Nil(t, s.Put([]byte("foo"), []byte("bar")))
+	value, err := s.Get([]byte("foo"))
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", string(value))
+
+	// flip the last byte of the value on disk
+	e := s.entryCache.Get("foo")
+	_, err = s.writeFile.fp.WriteAt([]byte("x"), int64(e.ValueOffset+uint64(e.ValueSize)-1))
+	assert.Nil(t, err)
+	_, err = s.Get([]byte("foo"))
+	assert.T(t, errors.Is(err, ErrCrc32), err)
+	assert.Equal(t, uint64(1), s.Stats().ChecksumFailures)
+}
+
+func TestPutWithTTL(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	assert.Nil(t, s.PutWithTTL([]byte("session"), []byte("data"), time.Second))
+	assert.Nil(t, s.PutWithTTL([]byte("forever"), []byte("data"), 0))
+	value, err := s.Get([]byte("session"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(value))
+	ttl, err := s.TTL([]byte("session"))
+	assert.Nil(t, err)
+	assert.T(t, ttl > 0 && ttl <= 2*time.Second)
+	ttl, err = s.TTL([]byte("forever"))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	time.Sleep(2 * time.Second)
+	_, err = s.TTL([]byte("session"))
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Get([]byte("session"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	_, err = s.Get([]byte("session"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrNotFound, s.Del([]byte("session")))
+	_, err = s.Get([]byte("forever"))
+	assert.Nil(t, err)
+}
+
+func TestSnapshot(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("old")))
+	}
+	snap, err := s.Snapshot()
+	assert.Nil(t, err)
+
+	// later writes land in a new data file
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("new")))
+	}
+	assert.Nil(t, s.Del([]byte("key-0")))
+	assert.Nil(t, s.Put([]byte("key-10"), []byte("new")))
+
+	// merge leaves the pinned files alone
+	assert.Nil(t, s.Merge())
+	ids, err := immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ids))
+
+	value, err := snap.Get([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(value))
+	_, err = snap.Get([]byte("key-10"))
+	assert.Equal(t, ErrNotFound, err)
+
+	it := snap.NewIterator(nil)
+	n := 0
+	for ok := it.First(); ok; ok = it.Next() {
+		value, err := it.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, "old", string(value))
+		n++
+	}
+	assert.Equal(t, 10, n)
+
+	snap.Release()
+	snap.Release()
+	assert.Nil(t, s.Merge())
+	ids, err = immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ids))
+	value, err = s.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(value))
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+
+	version, err := s.PutIfAbsent([]byte("key"), []byte("v1"), 0, 0)
+	assert.Nil(t, err)
+	_, err = s.PutIfAbsent([]byte("key"), []byte("v2"), 0, 0)
+	assert.Equal(t, ErrKeyExists, err)
+
+	value, v, err := s.GetWithVersion([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(value))
+	assert.Equal(t, version, v)
+
+	assert.Equal(t, ErrVersionMismatch, s.CompareAndSwap([]byte("key"), []byte("v0"), []byte("v2")))
+	assert.Nil(t, s.CompareAndSwap([]byte("key"), []byte("v1"), []byte("v2")))
+	assert.Equal(t, ErrNotFound, s.CompareAndSwap([]byte("missing"), nil, []byte("v2")))
+
+	// the old version is stale after the swap
+	_, err = s.CompareAndSwapVersion([]byte("key"), version, []byte("v3"), 0, 0)
+	assert.Equal(t, ErrVersionMismatch, err)
+	_, v, err = s.GetWithVersion([]byte("key"))
+	assert.Nil(t, err)
+	version, err = s.CompareAndSwapVersion([]byte("key"), v, []byte("v3"), 0, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, v, version)
+
+	assert.Equal(t, ErrVersionMismatch, s.DeleteIfVersion([]byte("key"), v))
+	assert.Nil(t, s.DeleteIfVersion([]byte("key"), version))
+	_, err = s.Get([]byte("key"))
+	assert.Equal(t, ErrNotFound, err)
+
+	// an expired key is absent
+	_, err = s.PutIfAbsent([]byte("session"), []byte("v1"), 0, time.Second)
+	assert.Nil(t, err)
+	time.Sleep(2100 * time.Millisecond)
+	_, err = s.PutIfAbsent([]byte("session"), []byte("v2"), 0, 0)
+	assert.Nil(t, err)
+}
+
+func TestMeta(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+
+	// the value reads the same with any meta, even when it looks like one
+	_, err := s.PutWithMeta([]byte("item"), []byte("\x00mcf\x00\x00\x00\x07data"), 42, 0)
+	assert.Nil(t, err)
+	_, err = s.PutWithMeta([]byte("plain"), []byte("\x00mcf\x00\x00\x00\x07data"), 0, 0)
+	assert.Nil(t, err)
+	check := func(s *Storage) {
+		for key, meta := range map[string]uint32{"item": 42, "plain": 0} {
+			value, err := s.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, "\x00mcf\x00\x00\x00\x07data", string(value))
+			value, m, _, err := s.GetWithMeta([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, "\x00mcf\x00\x00\x00\x07data", string(value))
+			assert.Equal(t, meta, m)
+		}
+	}
+	check(s)
+
+	// the meta stays through a reopen and a merge
+	assert.Nil(t, s.Close())
+	s = openTestStorage(t, dir)
+	check(s)
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, s.Put([]byte("fill"), bytes.Repeat([]byte("f"), 200)))
+	assert.Nil(t, s.Put([]byte("fill"), []byte("f")))
+	assert.Nil(t, s.Merge())
+	check(s)
+
+	// a put without one drops it
+	assert.Nil(t, s.Put([]byte("item"), []byte("v")))
+	_, m, _, err := s.GetWithMeta([]byte("item"))
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), m)
+	assert.Nil(t, s.Close())
+}
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	config := NewConfig()
+	config.Dir = dir
+	config.MergeSecs = 0
+	config.Compression = "gzip"
+	s := New(config)
+	assert.Nil(t, s.Open())
+
+	big := []byte(strings.Repeat(`{"name":"mouse","tags":["a","b"]}`, 100))
+	assert.Nil(t, s.Put([]byte("big"), big))
+	assert.Nil(t, s.Put([]byte("small"), []byte("raw")))
+	e := s.entryCache.Get("big")
+	assert.NotEqual(t, uint32(0), e.Flags&flagCodecMask)
+	assert.Equal(t, true, e.ValueSize < uint32(len(big)))
+	assert.Equal(t, uint32(0), s.entryCache.Get("small").Flags&flagCodecMask)
+	value, err := s.Get([]byte("big"))
+	assert.Nil(t, err)
+	assert.Equal(t, string(big), string(value))
+	assert.Nil(t, s.Close())
+
+	// values written by another codec stay readable
+	config.Compression = "deflate"
+	config.CheckSumCrc32 = true
+	s = New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	assert.Nil(t, s.Put([]byte("big2"), big))
+	for _, key := range []string{"big", "big2"} {
+		value, err := s.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, string(big), string(value))
+	}
+	value, err = s.Get([]byte("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, "raw", string(value))
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := t.TempDir() + "/keys"
+	key1 := "1:" + strings.Repeat("01", 32)
+	key2 := "2:" + strings.Repeat("02", 32)
+	assert.Nil(t, os.WriteFile(keyFile, []byte(key1+"\n"), 0600))
+
+	config := NewConfig()
+	config.Dir = dir
+	config.MaxFileSize = 200
+	config.MergeSecs = 0
+	config.EncryptionKeyFile = keyFile
+	s := New(config)
+	assert.Nil(t, s.Open())
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("secret-key-%d", i)), []byte("secret-value")))
+	}
+	assert.Nil(t, s.Del([]byte("secret-key-0")))
+	assert.Nil(t, s.Close())
+
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		data, err := os.ReadFile(dir + "/" + f.Name())
+		assert.Nil(t, err)
+		assert.Equal(t, false, strings.Contains(string(data), "secret"))
+	}
+
+	// the records can't be read without the key
+	config.EncryptionKeyFile = ""
+	s = New(config)
+	assert.Equal(t, true, errors.Is(s.Open(), ErrDecrypt))
+
+	// rotate the key, merge encrypts the old records with the new key
+	assert.Nil(t, os.WriteFile(keyFile, []byte(key1+"\n"+key2+"\n"), 0600))
+	config.EncryptionKeyFile = keyFile
+	s = New(config)
+	assert.Nil(t, s.Open())
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, s.Put([]byte("secret-key-10"), []byte("secret-value")))
+	assert.Nil(t, s.Merge())
+	assert.Nil(t, s.Close())
+
+	config.EncryptionKeyEnv, config.EncryptionKeyFile = "MOUSEDB_TEST_KEYS", ""
+	t.Setenv("MOUSEDB_TEST_KEYS", key2)
+	s = New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	_, err = s.Get([]byte("secret-key-0"))
+	assert.Equal(t, ErrNotFound, err)
+	for i := 1; i <= 10; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("secret-key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "secret-value", string(value))
+	}
+}
+
+func TestEncryptionWithChecksum(t *testing.T) {
+	keyFile := t.TempDir() + "/keys"
+	assert.Nil(t, os.WriteFile(keyFile, []byte("1:"+strings.Repeat("01", 32)+"\n"), 0600))
+
+	config := NewConfig()
+	config.Dir = t.TempDir()
+	config.MaxFileSize = 200
+	config.MergeSecs = 0
+	config.CheckSumCrc32 = true
+	config.EncryptionKeyFile = keyFile
+	s := New(config)
+	assert.Nil(t, s.Open())
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i))))
+	}
+	value, err := s.Get([]byte("key-9"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value-9", string(value))
+	assert.Nil(t, s.Close())
+
+	// the entries loaded from the idx files and moved by merge
+	s = New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, s.Put([]byte("key-0"), []byte("value-0")))
+	assert.Nil(t, s.Merge())
+	for i := 0; i < 10; i++ {
+		value, err := s.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("value-%d", i), string(value))
+	}
+	assert.Equal(t, uint64(0), s.Stats().ChecksumFailures)
+}
+
+func TestGroupCommit(t *testing.T) {
+	config := NewConfig()
+	config.Dir = t.TempDir()
+	config.MergeSecs = 0
+	config.SyncMode = SyncAlways
+	s := New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte("value")))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every write returned once it was synced, some of them shared a sync
+	assert.Equal(t, s.written, s.synced)
+	syncs := s.Stats().Syncs
+	assert.NotEqual(t, uint64(0), syncs)
+	assert.Equal(t, true, syncs <= 400)
+}
+
+func TestSyncIntervalUnset(t *testing.T) {
+	// a Config not validated, the default interval is used
+	s := New(&Config{Dir: t.TempDir(), SyncMode: SyncInterval, ReadWrite: true, MaxFileSize: 1 << 20})
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.Put([]byte("key"), []byte("value")))
+	assert.Nil(t, s.Close())
+}
+
+func TestWriter(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+
+	// a record is read from the buffer until it is flushed
+	s.rwLock.Lock()
+	_, err := s.put([]byte("buffered"), []byte("value"), 0, 0)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(s.writeFile.buf))
+	value, err := s.readValue([]byte("buffered"), s.entryCache.Get("buffered"))
+	s.rwLock.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d-%d", i, j)), []byte("value")))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 0, len(s.writeFile.buf))
+	assert.Equal(t, true, s.Stats().WriteGroups <= 400)
+	assert.Nil(t, s.Close())
+	assert.Equal(t, ErrClosed, s.Put([]byte("key"), []byte("value")))
+
+	s = openTestStorage(t, dir)
+	defer s.Close()
+	assert.Equal(t, 401, s.entryCache.Len())
+	value, err = s.Get([]byte("buffered"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+}
+
+func TestWriteFailure(t *testing.T) {
+	config := NewConfig()
+	config.Dir = t.TempDir()
+	config.MergeSecs = 0
+	s := New(config)
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.Put([]byte("before"), []byte("value")))
+
+	// the writes to a file opened read only fail
+	ro, err := os.Open(s.writeFile.fp.Name())
+	assert.Nil(t, err)
+	s.rwLock.Lock()
+	fp := s.writeFile.fp
+	s.writeFile.fp = ro
+	s.rwLock.Unlock()
+	assert.NotEqual(t, nil, s.Put([]byte("failed"), []byte("value")))
+	s.rwLock.Lock()
+	s.writeFile.fp = fp
+	s.rwLock.Unlock()
+	assert.Nil(t, ro.Close())
+
+	// the storage refuses the writes once one failed
+	err = s.Put([]byte("after"), []byte("value"))
+	assert.Equal(t, true, errors.Is(err, ErrFailed))
+	assert.Equal(t, true, errors.Is(s.Del([]byte("before")), ErrFailed))
+	assert.Nil(t, s.Close())
+
+	// the failed writes never reach the disk
+	s = New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	value, err := s.Get([]byte("before"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(value))
+	_, err = s.Get([]byte("failed"))
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Get([]byte("after"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestGetView(t *testing.T) {
+	config := NewConfig()
+	config.Dir = t.TempDir()
+	config.MaxFileSize = 200
+	config.MergeSecs = 0
+	config.MmapReads = true
+	config.CheckSumCrc32 = true
+	s := New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("old")))
+	}
+	// the old values land in an immutable file
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("new")))
+	}
+
+	ids, err := immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ids))
+	view, err := s.GetView([]byte("key-9"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(view.Bytes()))
+	assert.NotEqual(t, 0, len(s.oldFile.get(ids[0]).mmap))
+
+	// the mapped file stays until the view is released
+	assert.Nil(t, s.Merge())
+	ids, err = immutableFileIDs(s, s.writeFile.fileID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ids))
+	assert.Equal(t, "old", string(view.Bytes()))
+	view.Release()
+	view.Release()
+	assert.Nil(t, s.Merge())
+
+	value, err := s.Get([]byte("key-9"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(value))
+	view, err = s.GetView([]byte("key-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(view.Bytes()))
+	view.Release()
+	_, err = s.GetView([]byte("missing"))
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestOpenFileOnce(t *testing.T) {
+	config := NewConfig()
+	config.Dir = t.TempDir()
+	config.MergeSecs = 0
+	config.MaxFileSize = 200
+	config.MmapReads = true
+	s := New(config)
+	assert.Nil(t, s.Open())
+	value := strings.Repeat("v", 200)
+	assert.Nil(t, s.Put([]byte("key"), []byte(value)))
+	fileID := s.writeFile.fileID
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, s.Put([]byte("other"), []byte(value)))
+	assert.NotEqual(t, fileID, s.writeFile.fileID)
+	assert.Nil(t, s.Close())
+
+	// the readers of a file not opened yet share the one kept
+	s = New(config)
+	assert.Nil(t, s.Open())
+	defer s.Close()
+	bfs := make([]*BFile, 8)
+	var wg sync.WaitGroup
+	for i := range bfs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.rwLock.RLock()
+			defer s.rwLock.RUnlock()
+			bf, err := s.getFileState(fileID)
+			assert.Nil(t, err)
+			bfs[i] = bf
+		}(i)
+	}
+	wg.Wait()
+	for _, bf := range bfs {
+		assert.Equal(t, s.oldFile.get(fileID), bf)
+	}
+	assert.Equal(t, 1, len(s.oldFile.bfs))
+	got, err := s.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, value, string(got))
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestStorage(t, dir)
+	defer w.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, w.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1")))
+	}
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+
+	config := NewConfig()
+	config.Dir = dir
+	config.ReadWrite = false
+	readers := []*Storage{New(config), New(config)}
+	for _, r := range readers {
+		assert.Nil(t, r.Open())
+		defer r.Close()
+	}
+	r := readers[0]
+	after, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(files), len(after))
+
+	value, err := r.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", string(value))
+	assert.Equal(t, ErrReadOnly, r.Put([]byte("key-1"), []byte("v2")))
+	assert.Equal(t, ErrReadOnly, r.Del([]byte("key-1")))
+	assert.Equal(t, ErrReadOnly, r.Merge())
+
+	// tail the records appended by the writer
+	assert.Nil(t, w.Put([]byte("key-1"), []byte("v2")))
+	assert.Nil(t, w.Del([]byte("key-2")))
+	b := NewBatch()
+	b.Put([]byte("key-10"), []byte("v1"))
+	b.Del([]byte("key-3"))
+	assert.Nil(t, w.Write(b))
+	assert.Nil(t, r.Refresh())
+	value, err = r.Get([]byte("key-1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", string(value))
+	for _, key := range []string{"key-2", "key-3"} {
+		_, err = r.Get([]byte(key))
+		assert.Equal(t, ErrNotFound, err)
+	}
+	assert.Equal(t, 9, r.entryCache.Len())
+
+	// a merge of the writer replaces the files, the keydir is loaded again
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, w.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v3")))
+	}
+	assert.Nil(t, w.Merge())
+	assert.Nil(t, r.Refresh())
+	for i := 0; i <= 10; i++ {
+		want, _ := w.Get([]byte(fmt.Sprintf("key-%d", i)))
+		value, _ := r.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Equal(t, string(want), string(value))
+	}
+	assert.Equal(t, w.entryCache.Len(), r.entryCache.Len())
+
+	config.Dir = dir + "/missing"
+	assert.NotEqual(t, nil, New(config).Open())
+}
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	// a lock file left by a crashed process doesn't hold the lock
+	assert.Nil(t, os.WriteFile(dir+"/"+lockFileName, []byte("999999999\t1.bsm"), 0644))
+	s := openTestStorage(t, dir)
+
+	config := NewConfig()
+	config.Dir = dir
+	config.OpenTimeoutSecs = 1
+	start := time.Now()
+	err := New(config).Open()
+	assert.Equal(t, true, errors.Is(err, ErrLocked))
+	assert.Equal(t, true, strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())))
+	assert.Equal(t, true, time.Since(start) >= time.Second)
+
+	// the lock is taken once the holder closes
+	holder := s
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		holder.Close()
+	}()
+	s = New(config)
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.Close())
+	s = New(config)
+	assert.Nil(t, s.Open())
+	assert.Nil(t, s.Close())
+}
+
+func TestBackup(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1")))
+	}
+	// the writeable file can be rotated once its second is over
+	time.Sleep(1100 * time.Millisecond)
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	manifest, err := s.BackupDir(dir)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(manifest.Files))
+	for _, f := range manifest.Files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name))
+		assert.Nil(t, err)
+		sum := sha256.Sum256(data)
+		assert.Equal(t, f.SHA256, hex.EncodeToString(sum[:]))
+	}
+	_, err = os.Stat(filepath.Join(dir, BackupManifestName))
+	assert.Nil(t, err)
+
+	// the writes after the backup are not in it
+	assert.Nil(t, s.Put([]byte("key-0"), []byte("v2")))
+	var buf bytes.Buffer
+	_, err = s.Backup(&buf)
+	assert.Nil(t, err)
+	tr := tar.NewReader(&buf)
+	var last string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		last = header.Name
+	}
+	assert.Equal(t, BackupManifestName, last)
+
+	b := openTestStorage(t, dir)
+	defer b.Close()
+	for i := 0; i < 10; i++ {
+		value, err := b.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v1", string(value))
+	}
+}
+
+func TestBackupReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestStorage(t, dir)
+	defer w.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, w.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1")))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, w.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v2")))
+	}
+	assert.Nil(t, w.Del([]byte("key-0")))
+
+	config := NewConfig()
+	config.Dir = dir
+	config.ReadWrite = false
+	config.MergeSecs = 0
+	r := New(config)
+	assert.Nil(t, r.Open())
+	defer r.Close()
+
+	// a merge of the writer while the files are copied fails the backup
+	sources, release, err := r.backupSources()
+	assert.Nil(t, err)
+	assert.Nil(t, r.checkSources(sources))
+	assert.Nil(t, w.Merge())
+	assert.Equal(t, true, errors.Is(r.checkSources(sources), ErrBackupChanged))
+	release()
+
+	backup := filepath.Join(t.TempDir(), "backup")
+	_, err = r.BackupDir(backup)
+	assert.Nil(t, err)
+	b := openTestStorage(t, backup)
+	defer b.Close()
+	_, err = b.Get([]byte("key-0"))
+	assert.Equal(t, ErrNotFound, err)
+	for i := 1; i < 10; i++ {
+		value, err := b.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v2", string(value))
+	}
+}
+
+func TestRestore(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1")))
+	}
+	time.Sleep(1100 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(1100 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, s.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v2")))
+	}
+	assert.Nil(t, s.Del([]byte("key-9")))
+	var buf bytes.Buffer
+	_, err := s.Backup(&buf)
+	assert.Nil(t, err)
+	backup := buf.Bytes()
+
+	// a damaged backup is refused
+	damaged := append([]byte(nil), backup...)
+	damaged[600] ^= 0xff
+	dir := t.TempDir()
+	_, err = Restore(bytes.NewReader(damaged), dir, nil)
+	assert.Equal(t, true, errors.Is(err, ErrBadBackup))
+	names, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	_, err = Restore(bytes.NewReader(backup), dir, nil)
+	assert.Nil(t, err)
+	r := openTestStorage(t, dir)
+	for i := 0; i < 9; i++ {
+		want, _ := s.Get([]byte(fmt.Sprintf("key-%d", i)))
+		value, err := r.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, string(want), string(value))
+	}
+	_, err = r.Get([]byte("key-9"))
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, r.Close())
+
+	// recover to just before the second round of writes
+	dir = t.TempDir()
+	_, err = Restore(bytes.NewReader(backup), dir, &RestoreOptions{Until: until})
+	assert.Nil(t, err)
+	r = openTestStorage(t, dir)
+	defer r.Close()
+	for i := 0; i < 10; i++ {
+		value, err := r.Get([]byte(fmt.Sprintf("key-%d", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "v1", string(value))
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	defer s.Close()
+	values := map[string]string{
+		"text":    "a value, with \"quotes\"\nand a newline",
+		"binary":  "\x00\xff\xfe",
+		"\xffkey": "binary key",
+	}
+	for key, value := range values {
+		assert.Nil(t, s.Put([]byte(key), []byte(value)))
+	}
+	assert.Nil(t, s.PutWithTTL([]byte("ttl"), []byte("expires"), time.Hour))
+	values["ttl"] = "expires"
+	_, err := s.PutWithMeta([]byte("meta"), []byte("with meta"), 7, 0)
+	assert.Nil(t, err)
+	values["meta"] = "with meta"
+
+	for _, format := range []string{FormatJSONL, FormatCSV} {
+		var buf bytes.Buffer
+		n, err := s.Export(&buf, &ExportOptions{Format: format})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(values)), n)
+
+		r := openTestStorage(t, t.TempDir())
+		var progress uint64
+		n, err = r.Import(&buf, &ImportOptions{Format: format, BatchSize: 3, Progress: func(n uint64) { progress = n }})
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(len(values)), n)
+		assert.Equal(t, n, progress)
+		for key, want := range values {
+			value, err := r.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(value))
+		}
+		e := r.entryCache.Get("ttl")
+		assert.Equal(t, s.entryCache.Get("ttl").Expiry, e.Expiry)
+		_, meta, _, err := r.GetWithMeta([]byte("meta"))
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(7), meta)
+		assert.Nil(t, r.Close())
+	}
+
+	// a CSV file exported before the meta column
+	r := openTestStorage(t, t.TempDir())
+	n, err := r.Import(strings.NewReader("key,value,encoding,timestamp,expires_at\nold,v,,0,0\n"), &ImportOptions{Format: FormatCSV})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), n)
+	assert.Nil(t, r.Close())
+
+	var buf bytes.Buffer
+	_, err = s.Export(&buf, &ExportOptions{Format: "xml"})
+	assert.Equal(t, true, errors.Is(err, ErrFormat))
+}
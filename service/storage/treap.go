@@ -0,0 +1,218 @@
+package storage
+
+import "hash/maphash"
+
+// seed of the node priorities, random per process
+var treapSeed = maphash.MakeSeed()
+
+// node is a node of a persistent treap ordered by key. Nodes are never
+// changed once they are reachable from a root: an update copies the path
+// from the root to the changed node, so a root always stays a consistent
+// view of the keys, which can be read without holding a lock. The entry is
+// held by value, it is shared by pointer with the readers since it is never
+// changed either.
+type node struct {
+	key      string
+	e        entry
+	priority uint64
+	left     *node
+	right    *node
+}
+
+// treapInsert returns the root of n with key set to e, and whether the key is new.
+func treapInsert(n *node, key string, e *entry, priority uint64) (*node, bool) {
+	if n == nil {
+		return &node{key: key, e: *e, priority: priority}, true
+	}
+	c := *n
+	switch {
+	case key < n.key:
+		l, added := treapInsert(n.left, key, e, priority)
+		c.left = l
+		if l.priority > c.priority {
+			return rotateRight(&c), added
+		}
+		return &c, added
+	case key > n.key:
+		r, added := treapInsert(n.right, key, e, priority)
+		c.right = r
+		if r.priority > c.priority {
+			return rotateLeft(&c), added
+		}
+		return &c, added
+	default:
+		c.e = *e
+		return &c, false
+	}
+}
+
+// rotateRight lifts the left child of n, both must be fresh copies.
+func rotateRight(n *node) *node {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	return l
+}
+
+// rotateLeft lifts the right child of n, both must be fresh copies.
+func rotateLeft(n *node) *node {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	return r
+}
+
+// treapDelete returns the root of n without key, and whether the key existed.
+func treapDelete(n *node, key string) (*node, bool) {
+	if n == nil {
+		return nil, false
+	}
+	switch {
+	case key < n.key:
+		l, ok := treapDelete(n.left, key)
+		if !ok {
+			return n, false
+		}
+		c := *n
+		c.left = l
+		return &c, true
+	case key > n.key:
+		r, ok := treapDelete(n.right, key)
+		if !ok {
+			return n, false
+		}
+		c := *n
+		c.right = r
+		return &c, true
+	default:
+		return treapJoin(n.left, n.right), true
+	}
+}
+
+// treapJoin joins two treaps where all keys of a are less than the keys of b.
+func treapJoin(a, b *node) *node {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		c := *a
+		c.right = treapJoin(a.right, b)
+		return &c
+	}
+	c := *b
+	c.left = treapJoin(a, b.left)
+	return &c
+}
+
+// treapGet returns the node of key.
+func treapGet(n *node, key string) *node {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+// treapCeiling returns the node with the smallest key >= key, or > key if strict.
+func treapCeiling(n *node, key string, strict bool) *node {
+	var best *node
+	for n != nil {
+		if n.key > key || (!strict && n.key == key) {
+			best = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return best
+}
+
+// treapFloor returns the node with the largest key <= key, or < key if strict.
+func treapFloor(n *node, key string, strict bool) *node {
+	var best *node
+	for n != nil {
+		if n.key < key || (!strict && n.key == key) {
+			best = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	return best
+}
+
+// treapFirst returns the node with the smallest key.
+func treapFirst(n *node) *node {
+	for n != nil && n.left != nil {
+		n = n.left
+	}
+	return n
+}
+
+// treapLast returns the node with the largest key.
+func treapLast(n *node) *node {
+	for n != nil && n.right != nil {
+		n = n.right
+	}
+	return n
+}
+
+// treapWalk calls fn for every node in key order until fn returns false.
+func treapWalk(n *node, fn func(n *node) bool) bool {
+	if n == nil {
+		return true
+	}
+	return treapWalk(n.left, fn) && fn(n) && treapWalk(n.right, fn)
+}
+
+// keyPriority returns the treap priority of key.
+func keyPriority(key string) uint64 {
+	return maphash.String(treapSeed, key)
+}
+
+// viewGet returns the node of key in the view.
+func viewGet(v *keydirView, key string) *node {
+	return treapGet(v[shardOf(keyPriority(key))], key)
+}
+
+// viewCeiling returns the node with the smallest key >= key of all shards, or > key if strict.
+func viewCeiling(v *keydirView, key string, strict bool) *node {
+	var best *node
+	for _, root := range v {
+		if n := treapCeiling(root, key, strict); n != nil && (best == nil || n.key < best.key) {
+			best = n
+		}
+	}
+	return best
+}
+
+// viewFloor returns the node with the largest key <= key of all shards, or < key if strict.
+func viewFloor(v *keydirView, key string, strict bool) *node {
+	var best *node
+	for _, root := range v {
+		if n := treapFloor(root, key, strict); n != nil && (best == nil || n.key > best.key) {
+			best = n
+		}
+	}
+	return best
+}
+
+// viewLast returns the node with the largest key of all shards.
+func viewLast(v *keydirView) *node {
+	var best *node
+	for _, root := range v {
+		if n := treapLast(root); n != nil && (best == nil || n.key > best.key) {
+			best = n
+		}
+	}
+	return best
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 const (
@@ -14,26 +16,58 @@ const (
 )
 
 // if writeableFile size large than Opts.MaxFileSize and the fileID not equal to local time stamp;
-// if will create a new writeable file
-func checkWriteableFile(storage *Storage) {
+// if will create a new writeable file. It runs on the writer.
+func checkWriteableFile(storage *Storage) error {
 	if storage.writeFile.writeOffset > storage.Config.MaxFileSize && storage.writeFile.fileID != uint32(time.Now().Unix()) {
 		storage.Logger.Info(fmt.Sprintf("open a new data/idx file: %d, %d", storage.writeFile.writeOffset, storage.Config.MaxFileSize))
-		//close data/idx fp
-		storage.writeFile.idxFp.Close()
-		storage.writeFile.fp.Close()
-
-		writeFp, fileID := setWriteableFile(0, storage.dirFile)
-		idxFp := setIdxFile(fileID, storage.dirFile)
-		bf := &BFile{
-			fp:          writeFp,
-			fileID:      fileID,
-			writeOffset: 0,
-			idxFp:       idxFp,
+		return rotateWriteable(storage)
+	}
+	return nil
+}
+
+// rotateWriteable flushes and closes the writeable file, then opens a new
+// one, the id of the writeable file must be older than the current second.
+// It runs on the writer.
+func rotateWriteable(storage *Storage) error {
+	if err := storage.writeFile.flush(); err != nil {
+		return err
+	}
+	storage.flushed = storage.written
+	// only the tail of the last data/idx pair is recovered on open, the full
+	// pair goes to disk before it is closed
+	if storage.Config.SyncMode != SyncNone {
+		if err := storage.writeFile.fp.Sync(); err != nil {
+			storage.Logger.Error("sync the data file failed", zap.Error(err))
 		}
-		storage.writeFile = bf
-		// update pid
-		writePID(storage.lockFile, fileID)
+		if err := storage.writeFile.idxFp.Sync(); err != nil {
+			storage.Logger.Error("sync the idx file failed", zap.Error(err))
+		}
+	}
+	//close data/idx fp
+	storage.writeFile.idxFp.Close()
+	storage.writeFile.fp.Close()
+
+	writeFp, fileID := setWriteableFile(0, storage.dirFile)
+	idxFp := setIdxFile(fileID, storage.dirFile)
+	bf := &BFile{
+		fp:          writeFp,
+		fileID:      fileID,
+		writeOffset: 0,
+		idxFp:       idxFp,
+	}
+	storage.writeFile = bf
+	// update pid
+	writePID(storage.lockFile, fileID)
+	return nil
+}
+
+// return the unix time a value put now with ttl expires at, 0 never expires
+func expiryOf(ttl time.Duration) uint32 {
+	if ttl <= 0 {
+		return 0
 	}
+	secs := (ttl + time.Second - 1) / time.Second
+	return uint32(time.Now().Unix() + int64(secs))
 }
 
 // return the idx file lists
@@ -52,7 +86,7 @@ func listIdxFiles(storage *Storage) ([]string, error) {
 
 	var idxLists []string
 	for _, v := range lists {
-		if strings.Contains(v, "idx") && !existsSuffixs(filterFiles, v) {
+		if strings.HasSuffix(v, IDX) && !existsSuffixs(filterFiles, v) {
 			idxLists = append(idxLists, v)
 		}
 	}
@@ -75,7 +109,7 @@ func listDataFiles(storage *Storage) ([]string, error) {
 
 	var dataFileLists []string
 	for _, v := range lists {
-		if strings.Contains(v, BSM) && !existsSuffixs(filterFiles, v) {
+		if strings.HasSuffix(v, BSM) && !existsSuffixs(filterFiles, v) {
 			dataFileLists = append(dataFileLists, v)
 		}
 	}
@@ -83,11 +117,6 @@ func listDataFiles(storage *Storage) ([]string, error) {
 	return dataFileLists, nil
 }
 
-// lock a file by fp locker; the file must exits
-func lockFile(fileName string) (*os.File, error) {
-	return os.OpenFile(fileName, os.O_EXCL|os.O_CREATE|os.O_RDWR, os.ModePerm)
-}
-
 func existsSuffixs(suffixs []string, src string) (b bool) {
 	for _, suffix := range suffixs {
 		if b = strings.HasSuffix(src, suffix); b {
@@ -98,7 +127,9 @@ func existsSuffixs(suffixs []string, src string) (b bool) {
 }
 
 func writePID(pidFp *os.File, fileID uint32) {
-	pidFp.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\t"+strconv.Itoa(int(fileID))+BSM), 0)
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\t" + strconv.Itoa(int(fileID)) + BSM)
+	pidFp.WriteAt(pid, 0)
+	pidFp.Truncate(int64(len(pid)))
 }
 
 // get file last idx file info
@@ -163,15 +194,6 @@ func setIdxFile(fileID uint32, dirName string) *os.File {
 	return fp
 }
 
-func appendWriteFile(fp *os.File, buf []byte) (int, error) {
-	stat, err := fp.Stat()
-	if err != nil {
-		return -1, err
-	}
-
-	return fp.WriteAt(buf, stat.Size())
-}
-
 // return a unique not exists file name by timeStamp
 func uniqueFileName(root, suffix string) string {
 	for {
@@ -183,3 +205,35 @@ func uniqueFileName(root, suffix string) string {
 		time.Sleep(time.Second)
 	}
 }
+
+// parse the file id from a data or idx file name, e.g. /data/1675749210.bsm
+func fileIDFromName(fileName, suffix string) (uint32, error) {
+	s := strings.LastIndex(fileName, "/") + 1
+	e := strings.LastIndex(fileName, suffix)
+	if e < s {
+		return 0, fmt.Errorf("invalid file name: %s", fileName)
+	}
+	id, err := strconv.ParseUint(fileName[s:e], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(id), nil
+}
+
+// return the sorted ids of data files which are older than the writeable file
+func immutableFileIDs(storage *Storage, activeID uint32) ([]uint32, error) {
+	files, err := listDataFiles(storage)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint32, 0, len(files))
+	for _, name := range files {
+		id, err := fileIDFromName(name, BSM)
+		if err != nil || id >= activeID {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
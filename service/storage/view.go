@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// View is a value returned by GetView. Its bytes stay valid until Release is
+// called, they must not be modified.
+type View struct {
+	data    []byte
+	release func()
+	once    sync.Once
+}
+
+// Bytes returns the value, it must not be used after Release.
+func (v *View) Bytes() []byte {
+	return v.data
+}
+
+// Release lets the storage reuse the memory of the value, it may be called more than once.
+func (v *View) Release() {
+	v.once.Do(func() {
+		v.data = nil
+		if v.release != nil {
+			v.release()
+		}
+	})
+}
+
+// GetView returns the value of key without copying it when it is stored raw
+// in a mapped data file, see Config.MmapReads. The file is pinned against
+// merge until the View is released, a View must be released before Close.
+// Other values are returned as a copy.
+func (storage *Storage) GetView(key []byte) (*View, error) {
+	storage.rwLock.RLock()
+	defer storage.rwLock.RUnlock()
+
+	e := storage.liveEntry(key)
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	if e.Flags&(flagCodecMask|flagKeyMask) == 0 {
+		bf, err := storage.getFileState(e.FileID)
+		if err != nil {
+			return nil, err
+		}
+		start := e.ValueOffset - uint64(HeaderSize+e.KeySize)
+		end := e.ValueOffset + uint64(e.ValueSize)
+		if bf.mmap != nil && end <= uint64(len(bf.mmap)) {
+			if storage.Config.CheckSumCrc32 {
+				if err := verifyEntry(bf.mmap[start:end]); err != nil {
+					err = fmt.Errorf("%w: file id %d, offset %d", err, bf.fileID, start)
+					atomic.AddUint64(&storage.stats.ChecksumFailures, 1)
+					storage.Logger.Error("checksum of the value failed", zap.ByteString("key", key), zap.Error(err))
+					return nil, err
+				}
+			}
+			fileID := e.FileID
+			storage.oldFile.pin(fileID)
+			return &View{
+				data:    bf.mmap[e.ValueOffset:end:end],
+				release: func() { storage.oldFile.unpin(fileID) },
+			}, nil
+		}
+	}
+
+	value, err := storage.readValue(key, e)
+	if err != nil {
+		return nil, err
+	}
+	return &View{data: value}, nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// the most writes appended together before they are flushed
+const maxWriteGroup = 256
+
+// ErrClosed is returned by the writes made after the storage is closed.
+var ErrClosed = fmt.Errorf("storage is closed")
+
+// ErrFailed is returned by the writes made after a write failed to reach the
+// writeable file. The records after the failure are never flushed, though
+// their values may be read until the storage is reopened to write again.
+var ErrFailed = fmt.Errorf("storage failed to write")
+
+// writeRequest is a write waiting for the writer.
+type writeRequest struct {
+	fn   func() error // checks and appends the write, under rwLock
+	done chan error   // receives the result once the write is flushed
+}
+
+// commit hands the write fn to the writer and waits for it to be flushed,
+// and synced as well if Config.SyncMode is always.
+func (storage *Storage) commit(fn func() error) error {
+	if !storage.Config.ReadWrite {
+		return ErrReadOnly
+	}
+	req := &writeRequest{fn: fn, done: make(chan error, 1)}
+	select {
+	case storage.writes <- req:
+	case <-storage.closing:
+		return ErrClosed
+	}
+	return <-req.done
+}
+
+// writeLoop is the single writer of the storage. It takes the writes waiting
+// at once as a group, appends them to the buffer of the writeable file, then
+// writes the data and idx records of the group with one write each.
+func (storage *Storage) writeLoop() {
+	defer storage.wg.Done()
+	group := make([]*writeRequest, 0, maxWriteGroup)
+	for {
+		select {
+		case req := <-storage.writes:
+			group = append(group[:0], req)
+		more:
+			for len(group) < maxWriteGroup {
+				select {
+				case req := <-storage.writes:
+					group = append(group, req)
+				default:
+					break more
+				}
+			}
+			storage.writeGroup(group)
+		case <-storage.closing:
+			return
+		}
+	}
+}
+
+// writeGroup appends, flushes and syncs a group of writes, then reports the
+// result to every write. A failed flush or sync fails the storage, since the
+// entries of the group are in the keydir already.
+func (storage *Storage) writeGroup(group []*writeRequest) {
+	errs := make([]error, len(group))
+	storage.rwLock.Lock()
+	err := storage.failed
+	for i, req := range group {
+		if err != nil {
+			errs[i] = fmt.Errorf("%w: %v", ErrFailed, err)
+			continue
+		}
+		if errs[i] = req.fn(); errs[i] == nil {
+			storage.written++
+		}
+	}
+	storage.rwLock.Unlock()
+	if err != nil {
+		for i, req := range group {
+			req.done <- errs[i]
+		}
+		return
+	}
+
+	err = storage.flushWriteable()
+	if err == nil && storage.Config.SyncMode == SyncAlways {
+		err = storage.syncWriteable()
+	}
+	if err != nil {
+		storage.fail(err)
+	}
+	for i, req := range group {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		req.done <- errs[i]
+	}
+	atomic.AddUint64(&storage.stats.WriteGroups, 1)
+}
+
+// flushWriteable writes the buffered records into the writeable file. The
+// readers are only kept out while the buffers are emptied.
+func (storage *Storage) flushWriteable() error {
+	bf := storage.writeFile
+	if err := bf.writeBuffered(); err != nil {
+		return err
+	}
+	storage.rwLock.Lock()
+	bf.dropBuffered()
+	storage.flushed = storage.written
+	storage.rwLock.Unlock()
+	return nil
+}
+
+// fail stops the writes after err, a failed flush or sync after which the
+// writes may not have reached the disk.
+func (storage *Storage) fail(err error) {
+	storage.Logger.Error("the writeable file failed, the writes are refused until the storage is reopened", zap.Error(err))
+	storage.rwLock.Lock()
+	if storage.failed == nil {
+		storage.failed = err
+	}
+	storage.rwLock.Unlock()
+}